@@ -5,9 +5,13 @@ import (
 	"enforce-shared-lb/internal/api"
 	"enforce-shared-lb/internal/cache"
 	"enforce-shared-lb/internal/config"
-	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
 	"enforce-shared-lb/internal/processor"
+	"enforce-shared-lb/internal/processor/reconcile"
 	"enforce-shared-lb/internal/provider/events"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/queue"
+	"enforce-shared-lb/internal/utils"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -22,10 +26,12 @@ import (
 )
 
 var (
-	eventCh    chan model.Event
 	cancelFunc context.CancelFunc
 	ctx        context.Context
 	server     *http.Server
+
+	runCmd     = kingpin.Command("run", "Run the controller").Default()
+	recoverCmd = kingpin.Command("recover", "Rebuild redis state from the annotations of managed services")
 )
 
 func init() {
@@ -47,24 +53,41 @@ func init() {
 }
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
 	// load config
 	config.Init()
 	cache.New(config.RedisCli, config.Conf.KeyPrefix, config.Conf.Cloud.Max)
+	for _, name := range config.Conf.PoolNames() {
+		cache.DB.AddPool(name, config.Conf.PoolMax(name))
+	}
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	// 命名空间范围
+	namespace.New()
+	err := namespace.S.Start(ctx)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	if command == recoverCmd.FullCommand() {
+		recoverState()
+		return
+	}
 	router := api.Router()
 	// init events
 	events.Init(router)
-	eventCh = make(chan model.Event, config.Conf.ChannelSize)
-	ctx, cancelFunc = context.WithCancel(context.Background())
+	queue.New(
+		time.Duration(config.Conf.Queue.BaseDelay)*time.Second,
+		time.Duration(config.Conf.Queue.MaxDelay)*time.Second,
+		config.Conf.Queue.MaxRetries,
+	)
 	// run event consumer
 	logrus.Infoln("start event consumer")
-	err := processor.Consumer(ctx, eventCh)
+	err = processor.Consumer(ctx, queue.Q)
 	if err != nil {
 		logrus.Fatalln(err)
 	}
 	// run event producer
 	logrus.Infoln("start event producer")
-	events.Start(eventCh)
+	events.Start(queue.Q)
 	// start http server
 	server = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", config.Conf.Addr, config.Conf.Port),
@@ -81,6 +104,23 @@ func main() {
 	select {}
 }
 
+// recoverState 根据集群中service的注解重建redis中的分配状态
+func recoverState() {
+	accounts, err := loadbalancer.NewAccounts()
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+	reconcile.New(accounts, nil)
+	if reconcile.R == nil {
+		logrus.Fatalln("kubernetes client is not available")
+	}
+	report := reconcile.R.Recover(context.Background())
+	_ = utils.Json.NewEncoder(os.Stdout).Encode(report)
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
 func registerSignalHandlers() {
 	logrus.Infoln("register signal handlers")
 	sigs := make(chan os.Signal, 1)
@@ -100,8 +140,12 @@ func registerSignalHandlers() {
 		// 关闭事件接收器
 		events.Close()
 		// 关闭事件消费者
-		cancelFunc()
-		close(eventCh)
+		if cancelFunc != nil {
+			cancelFunc()
+		}
+		if queue.Q != nil {
+			queue.Q.ShutDown()
+		}
 		// 关闭redis连接
 		_ = config.RedisCli.Close()
 		os.Exit(0)
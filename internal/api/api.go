@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"enforce-shared-lb/internal/cache"
 	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/processor/reconcile"
+	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/queue"
 	"enforce-shared-lb/internal/utils"
 	"fmt"
 	"github.com/gin-contrib/cors"
@@ -42,6 +45,23 @@ type backendUri struct {
 	Name string `uri:"name" binding:"required"`
 }
 
+// quotaUsage 项目使用量及配额, 配额为0时不限制
+type quotaUsage struct {
+	Usage *cache.Usage `json:"usage"`
+	Quota config.Quota `json:"quota"`
+}
+
+func getQuotaUsage(project string) (*quotaUsage, error) {
+	usage, err := cache.DB.GetUsage(project)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaUsage{
+		Usage: usage,
+		Quota: config.Conf.ProjectQuota(project),
+	}, nil
+}
+
 func Router() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
@@ -64,8 +84,65 @@ func Router() *gin.Engine {
 	r.GET("/health", func(c *gin.Context) {
 		c.SecureJSON(http.StatusOK, utils.Response(http.StatusOK, nil, "running"))
 	})
+	r.GET("/ready", func(c *gin.Context) {
+		var pending []string
+		for _, e := range provider.EventList {
+			if s, ok := e.(provider.EventSynced); ok && !s.HasSynced() {
+				pending = append(pending, e.Name())
+			}
+		}
+		if len(pending) > 0 {
+			c.SecureJSON(http.StatusServiceUnavailable, utils.Response(http.StatusServiceUnavailable, pending, "not synced"))
+			return
+		}
+		c.SecureJSON(http.StatusOK, utils.Response(http.StatusOK, nil, "ready"))
+	})
 	api := r.Group("/api")
 	{
+		api.GET("queue", func(c *gin.Context) {
+			response(c, func() (interface{}, error) {
+				return queue.Q.Stats(), nil
+			})
+		})
+		api.GET("reconcile", func(c *gin.Context) {
+			if reconcile.R == nil {
+				c.SecureJSON(http.StatusOK, utils.Response(http.StatusServiceUnavailable, nil, "kubernetes client is not available"))
+				return
+			}
+			response(c, func() (interface{}, error) {
+				return reconcile.R.Last(), nil
+			})
+		})
+		api.POST("reconcile", func(c *gin.Context) {
+			if reconcile.R == nil {
+				c.SecureJSON(http.StatusOK, utils.Response(http.StatusServiceUnavailable, nil, "kubernetes client is not available"))
+				return
+			}
+			c.SecureJSON(http.StatusOK, utils.Response(http.StatusOK, reconcile.R.Run(c.Request.Context()), nil))
+		})
+		api.POST("recover", func(c *gin.Context) {
+			if reconcile.R == nil {
+				c.SecureJSON(http.StatusOK, utils.Response(http.StatusServiceUnavailable, nil, "kubernetes client is not available"))
+				return
+			}
+			c.SecureJSON(http.StatusOK, utils.Response(http.StatusOK, reconcile.R.Recover(c.Request.Context()), nil))
+		})
+		api.GET("quota", func(c *gin.Context) {
+			response(c, func() (interface{}, error) {
+				projects, err := cache.DB.GetProjects()
+				if err != nil {
+					return nil, err
+				}
+				var result = make(map[string]*quotaUsage)
+				for _, project := range projects {
+					result[project], err = getQuotaUsage(project)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return result, nil
+			})
+		})
 		api.GET("project", func(c *gin.Context) {
 			response(c, func() (interface{}, error) {
 				return cache.DB.ListProject()
@@ -79,7 +156,7 @@ func Router() *gin.Engine {
 				return
 			}
 			response(c, func() (interface{}, error) {
-				return cache.DB.ListLoadBalancerAmount(query.Project)
+				return cache.DB.Pool(c.Query("pool")).ListLoadBalancerAmount(query.Project)
 			})
 		})
 		api.GET(":project/loadbalancer/:id", func(c *gin.Context) {
@@ -90,7 +167,7 @@ func Router() *gin.Engine {
 				return
 			}
 			response(c, func() (interface{}, error) {
-				return cache.DB.ListLoadBalancer(query.Project, query.ID)
+				return cache.DB.Pool(c.Query("pool")).ListLoadBalancer(query.Project, query.ID)
 			})
 		})
 		api.GET(":project/loadbalancer/:id/:protocol", func(c *gin.Context) {
@@ -101,7 +178,18 @@ func Router() *gin.Engine {
 				return
 			}
 			response(c, func() (interface{}, error) {
-				return cache.DB.DetailLoadBalancer(query.Project, query.ID, query.Protocol)
+				return cache.DB.Pool(c.Query("pool")).DetailLoadBalancer(query.Project, query.ID, query.Protocol)
+			})
+		})
+		api.GET(":project/quota", func(c *gin.Context) {
+			var query baseUri
+			err := c.ShouldBindUri(&query)
+			if err != nil {
+				c.SecureJSON(http.StatusOK, utils.Response(http.StatusBadRequest, nil, err.Error()))
+				return
+			}
+			response(c, func() (interface{}, error) {
+				return getQuotaUsage(query.Project)
 			})
 		})
 		api.GET(":project/backend", func(c *gin.Context) {
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"github.com/go-redis/redis/v8"
+)
+
+// GetAffinity 获取亲和组绑定的LB, 未绑定或LB已不存在时返回空
+func (c *Cache) GetAffinity(project, group string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id, err := c.client.HGet(c.ctx, c.affinityKey(project), group).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	err = c.client.ZScore(c.ctx, c.loadBalancerKey(project, "amount"), id).Err()
+	if err == redis.Nil {
+		return "", c.client.HDel(c.ctx, c.affinityKey(project), group).Err()
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// SetAffinity 绑定亲和组到LB并记录成员, 已绑定时只记录成员
+func (c *Cache) SetAffinity(project, group, name, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.client.HSetNX(c.ctx, c.affinityKey(project), group, id).Err()
+	if err != nil {
+		return err
+	}
+	return c.client.HSet(c.ctx, c.affinityKey(project, "member"), name, group).Err()
+}
+
+// releaseAffinity 移除成员, 组内没有成员时解除绑定
+func (c *Cache) releaseAffinity(project, name string) error {
+	var key = c.affinityKey(project, "member")
+	group, err := c.client.HGet(c.ctx, key, name).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = c.client.HDel(c.ctx, key, name).Err()
+	if err != nil {
+		return err
+	}
+	groups, err := c.client.HVals(c.ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	for _, v := range groups {
+		if v == group {
+			return nil
+		}
+	}
+	return c.client.HDel(c.ctx, c.affinityKey(project), group).Err()
+}
+
+func (c *Cache) affinityKey(project string, key ...string) string {
+	return c.scopedKey(project, "affinity", key...)
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"github.com/go-redis/redis/v8"
+)
+
+// antiAffinityCounts 反亲和键在各LB上的service数量
+func (c *Cache) antiAffinityCounts(project, key string) (map[string]int, error) {
+	ids, err := c.client.HVals(c.ctx, c.antiAffinityKey(project, key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var counts = make(map[string]int)
+	for _, id := range ids {
+		counts[id]++
+	}
+	return counts, nil
+}
+
+// SetAntiAffinity 记录反亲和键下service所在的LB
+func (c *Cache) SetAntiAffinity(project, key, name, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.client.HSet(c.ctx, c.antiAffinityKey(project), name, key).Err()
+	if err != nil {
+		return err
+	}
+	return c.client.HSet(c.ctx, c.antiAffinityKey(project, key), name, id).Err()
+}
+
+// releaseAntiAffinity 移除service的反亲和记录
+func (c *Cache) releaseAntiAffinity(project, name string) error {
+	key, err := c.client.HGet(c.ctx, c.antiAffinityKey(project), name).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = c.client.HDel(c.ctx, c.antiAffinityKey(project, key), name).Err()
+	if err != nil {
+		return err
+	}
+	return c.client.HDel(c.ctx, c.antiAffinityKey(project), name).Err()
+}
+
+func (c *Cache) antiAffinityKey(project string, key ...string) string {
+	return c.scopedKey(project, "anti_affinity", key...)
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"enforce-shared-lb/internal/config"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
@@ -17,6 +18,9 @@ type Cache struct {
 	keyPrefix        string
 	maxNumOfBackends int64
 	ctx              context.Context
+	// pool 当前视图的负载均衡器池, pools为各池的最大数量
+	pool  string
+	pools map[string]int64
 }
 
 var DB *Cache
@@ -28,6 +32,10 @@ func New(client *redis.Client, keyPrefix string, maxNumOfBackends int64) {
 		maxNumOfBackends: maxNumOfBackends - 1,
 		lock:             new(sync.Mutex),
 		ctx:              context.Background(),
+		pool:             config.DefaultPool,
+		pools: map[string]int64{
+			config.DefaultPool: maxNumOfBackends - 1,
+		},
 	}
 }
 
@@ -45,6 +53,7 @@ VAL: <LoadBalancerID>
 KEY: <prefix>:<project>:backend:<name>
 VAL: <name>#<port>#<protocol>#<target_port>
 
+// 以下LB, 亲和及反亲和相关的键按池区分, 默认池之外的池 <project> 为 <project>:pool:<pool>
 // 存SLB的端口使用数量, 使用有序集合, 使用打分计算
 KEY: <prefix>:<project>:loadbalancer:amount
 VAL: <LoadBalancerID>
@@ -53,9 +62,62 @@ SCORE: <剩余量>
 // 存SLB端口唯一, 使用无序集合
 KEY: <prefix>:<project>:loadbalancer:<LoadBalancerID>:<protocol>
 VAL: <port>
+
+// 存独占的SLB, 使用无序集合
+KEY: <prefix>:<project>:loadbalancer:dedicated
+VAL: <LoadBalancerID>
+
+// 存亲和组绑定的SLB, 使用hash
+KEY: <prefix>:<project>:affinity
+FILED: <group>
+VAL: <LoadBalancerID>
+
+// 存亲和组成员, 使用hash
+KEY: <prefix>:<project>:affinity:member
+FILED: <name>
+VAL: <group>
+
+// 存service的反亲和键, 使用hash
+KEY: <prefix>:<project>:anti_affinity
+FILED: <name>
+VAL: <key>
+
+// 存反亲和键下service所在的SLB, 使用hash
+KEY: <prefix>:<project>:anti_affinity:<key>
+FILED: <name>
+VAL: <LoadBalancerID>
+
+// 存SLB所属的池, 使用hash, 不区分池
+KEY: <prefix>:<project>:loadbalancer:pool
+FILED: <LoadBalancerID>
+VAL: <pool>
+
+// 存SLB所属的云账号, 使用hash, 不区分池
+KEY: <prefix>:<project>:loadbalancer:owner
+FILED: <LoadBalancerID>
+VAL: <account>
+
+// 存SLB首次记录到缓存的时间, first-fit按此顺序选择, 使用hash, 不区分池
+KEY: <prefix>:<project>:loadbalancer:created
+FILED: <LoadBalancerID>
+VAL: <unix纳秒>
+
+// 存后端最近一次成功处理的事件来源 service, http 或 rabbitmq, 使用hash
+KEY: <prefix>:<project>:source
+FILED: <name>
+VAL: <source>
+
+// 存固定分配的健康检查端口, 使用hash
+KEY: <prefix>:health_check_node_port
+FILED: <project>/<name>
+VAL: <port>
 */
 
 func (c *Cache) ListProject() (interface{}, error) {
+	return c.GetProjects()
+}
+
+func (c *Cache) GetProjects() ([]string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	var key = fmt.Sprintf("%s:project", c.keyPrefix)
@@ -133,6 +195,11 @@ func (c *Cache) AddBackend(project, name, id string) error {
 }
 
 func (c *Cache) ListBackend(project string) (interface{}, error) {
+	return c.GetBackends(project)
+}
+
+// GetBackends 项目下后端名称与LoadBalancerID, 不含LB自身的占位成员
+func (c *Cache) GetBackends(project string) (map[string]string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	var key = c.backendKey(project)
@@ -153,6 +220,8 @@ type Port struct {
 	Protocol   string `json:"protocol"`
 	Port       int32  `json:"port"`
 	TargetPort int32  `json:"target_port"`
+	// Pin 外部端口的保留模式, 只在分配时使用
+	Pin string `json:"pin,omitempty"`
 }
 
 func (c *Cache) DetailBackend(project, name string) (interface{}, error) {
@@ -196,24 +265,95 @@ func (c *Cache) splitBackendPort(str string) (*Port, error) {
 	}, nil
 }
 
-func (c *Cache) GetAvailableLoadBalancer(project string, num int64) (string, error) {
+// Request LB选择条件
+type Request struct {
+	// Num 需要的数量
+	Num int64
+	// Ports 期望的外部端口, 用于计算端口冲突
+	Ports []*Port
+	// Exclude 不选择的LB
+	Exclude []string
+	// Strategy 选择策略
+	Strategy Strategy
+	// AntiAffinity 反亲和键, 同一LB上该键的service数量不超过MaxPerLB
+	AntiAffinity string
+	MaxPerLB     int
+}
+
+// GetAvailableLoadBalancer 按策略获取剩余量不小于num的LB, 跳过独占, exclude中及反亲和数量已满的LB
+func (c *Cache) GetAvailableLoadBalancer(project string, req *Request) (string, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	// 获取分数范围内元素
 	var key = c.loadBalancerKey(project, "amount")
 	var op = &redis.ZRangeBy{
-		Min: fmt.Sprintf("%d", num),
+		Min: fmt.Sprintf("%d", req.Num),
 		Max: fmt.Sprintf("%d", c.maxNumOfBackends),
 	}
-	res, err := c.client.ZRangeByScore(c.ctx, key, op).Result()
+	res, err := c.client.ZRangeByScoreWithScores(c.ctx, key, op).Result()
 	if err != nil {
 		return "", err
 	}
-	if len(res) <= 0 {
+	var counts map[string]int
+	if req.AntiAffinity != "" {
+		counts, err = c.antiAffinityCounts(project, req.AntiAffinity)
+		if err != nil {
+			return "", err
+		}
+	}
+	// 非独占且满足反亲和的作为候选
+	var candidates []*Candidate
+	for _, v := range res {
+		id, _ := v.Member.(string)
+		if excluded(req.Exclude, id) {
+			continue
+		}
+		if req.AntiAffinity != "" && counts[id] >= req.MaxPerLB {
+			continue
+		}
+		dedicated, err := c.client.SIsMember(c.ctx, c.loadBalancerKey(project, "dedicated"), id).Result()
+		if err != nil {
+			return "", err
+		}
+		if !dedicated {
+			candidates = append(candidates, &Candidate{ID: id, Remain: int64(v.Score)})
+		}
+	}
+	if len(candidates) == 0 {
 		return "", nil
 	}
-	// 取第一个
-	return res[0], nil
+	err = c.fillCreated(project, candidates)
+	if err != nil {
+		return "", err
+	}
+	var strategy = req.Strategy
+	if strategy == nil {
+		strategy, _ = GetStrategy("")
+	}
+	if aware, ok := strategy.(ConflictAware); ok && aware.ConflictAware() {
+		for _, v := range candidates {
+			v.Conflicts, err = c.countConflicts(project, v.ID, req.Ports)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return strategy.Select(candidates).ID, nil
+}
+
+// countConflicts 期望的外部端口在LB上已被占用的数量
+func (c *Cache) countConflicts(project, id string, ports []*Port) (int, error) {
+	var count int
+	for _, v := range ports {
+		used, err := c.client.SIsMember(c.ctx, c.loadBalancerKey(project, id, v.Protocol), v.Port).Result()
+		if err != nil {
+			return 0, err
+		}
+		if used {
+			count++
+		}
+	}
+	return count, nil
 }
 
 func (c *Cache) SetLoadBalancerAmount(project, id string, increment int64) error {
@@ -221,7 +361,15 @@ func (c *Cache) SetLoadBalancerAmount(project, id string, increment int64) error
 	defer c.lock.Unlock()
 	key := c.loadBalancerKey(project, "amount")
 	if increment == 0 {
-		// 设置初始分数
+		// 记录所属的池, 记录时间并设置初始分数
+		err := c.client.HSet(c.ctx, c.poolKey(project), id, c.pool).Err()
+		if err != nil {
+			return err
+		}
+		err = c.setCreated(project, id)
+		if err != nil {
+			return err
+		}
 		return c.client.ZAdd(c.ctx, key, &redis.Z{
 			Member: id,
 			Score:  float64(c.maxNumOfBackends),
@@ -230,6 +378,64 @@ func (c *Cache) SetLoadBalancerAmount(project, id string, increment int64) error
 	return c.client.ZIncrBy(c.ctx, key, float64(increment), id).Err()
 }
 
+// GetLoadBalancerAmount 获取LB剩余可用数量
+func (c *Cache) GetLoadBalancerAmount(project, id string) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	score, err := c.client.ZScore(c.ctx, c.loadBalancerKey(project, "amount"), id).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int64(score), nil
+}
+
+// Usage 项目已使用的LB数量及端口数
+type Usage struct {
+	LoadBalancers int64 `json:"loadbalancers"`
+	Ports         int64 `json:"ports"`
+}
+
+// GetUsage 统计项目在所有池中的使用量, 端口数由各LB已使用的数量累加
+func (c *Cache) GetUsage(project string) (*Usage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var usage = new(Usage)
+	for pool := range c.pools {
+		v := c.Pool(pool)
+		res, err := c.client.ZRangeWithScores(c.ctx, v.loadBalancerKey(project, "amount"), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range res {
+			usage.LoadBalancers++
+			usage.Ports += v.maxNumOfBackends - int64(z.Score)
+		}
+	}
+	return usage, nil
+}
+
+// SetLoadBalancerDedicated 标记LB为独占, 不会再被分配给其他后端
+func (c *Cache) SetLoadBalancerDedicated(project, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client.SAdd(c.ctx, c.loadBalancerKey(project, "dedicated"), id).Err()
+}
+
+// ExistLoadBalancer 项目中是否已记录该LB
+func (c *Cache) ExistLoadBalancer(project, id string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := c.loadBalancerKey(project, "amount")
+	err := c.client.ZScore(c.ctx, key, id).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (c *Cache) SetLoadBalancerUsingPorts(project, id, protocol string, ports []Port) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -302,8 +508,7 @@ func (c *Cache) SetBackend(project, name string, ports []Port) error {
 	var key = c.backendKey(project, name)
 	var members []interface{}
 	for _, p := range ports {
-		member := fmt.Sprintf("%s#%d#%s#%d", p.Name, p.Port, p.Protocol, p.TargetPort)
-		members = append(members, member)
+		members = append(members, backendMember(p))
 	}
 	err := c.client.SAdd(c.ctx, key, members...).Err()
 	if err != nil && err != redis.Nil {
@@ -313,6 +518,29 @@ func (c *Cache) SetBackend(project, name string, ports []Port) error {
 	return nil
 }
 
+// RemoveBackendPorts 释放后端的部分端口, 归还LB使用量
+func (c *Cache) RemoveBackendPorts(project, name, id string, ports []Port) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var members []interface{}
+	for _, p := range ports {
+		members = append(members, backendMember(p))
+	}
+	err := c.client.SRem(c.ctx, c.backendKey(project, name), members...).Err()
+	if err != nil && err != redis.Nil {
+		logrus.Error(err)
+		return err
+	}
+	var pool = c.poolOf(project, id)
+	pool.cleanPorts(project, id, ports)
+	err = c.client.ZIncrBy(c.ctx, pool.loadBalancerKey(project, "amount"), float64(len(ports)), id).Err()
+	if err != nil && err != redis.Nil {
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
 func (c *Cache) Clean(project, name string, ports []Port) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -322,17 +550,45 @@ func (c *Cache) Clean(project, name string, ports []Port) error {
 		return err
 	}
 
+	// LB所属池的视图
+	var pool = c
+	if id != "" {
+		pool = c.poolOf(project, id)
+	}
 	// 增加load balancer分数
 	if id != "" {
 		var increment = float64(int64(len(ports)))
-		err = c.client.ZIncrBy(c.ctx, c.loadBalancerKey(project, "amount"), increment, id).Err()
+		err = c.client.ZIncrBy(c.ctx, pool.loadBalancerKey(project, "amount"), increment, id).Err()
 		if err != nil && err != redis.Nil {
 			logrus.Error(err)
 			return err
 		}
 	}
 
-	c.cleanPorts(project, id, ports)
+	pool.cleanPorts(project, id, ports)
+	// 独占的LB释放后可重新共享或被自动清理
+	if id != "" {
+		err = c.client.SRem(c.ctx, pool.loadBalancerKey(project, "dedicated"), id).Err()
+		if err != nil && err != redis.Nil {
+			logrus.Warning(err)
+		}
+	}
+	err = c.releaseHealthCheckNodePort(project, name)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	err = pool.releaseAffinity(project, name)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	err = pool.releaseAntiAffinity(project, name)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	err = c.cleanBackendSource(project, name)
+	if err != nil {
+		logrus.Warning(err)
+	}
 	err = c.cleanBackend(project, name)
 	if err != nil {
 		return err
@@ -340,6 +596,29 @@ func (c *Cache) Clean(project, name string, ports []Port) error {
 	return c.cleanBackendSet(project, name)
 }
 
+// DrainProject 释放项目下所有后端占用的端口, 返回已释放的后端名称
+// LB保留在使用量集合中, 空闲后由自动清理回收
+func (c *Cache) DrainProject(project string) ([]string, error) {
+	backends, err := c.GetBackends(project)
+	if err != nil {
+		return nil, err
+	}
+	var drained []string
+	for name := range backends {
+		_, ports := c.GetBackendPorts(project, name)
+		var usingPorts []Port
+		for _, v := range ports {
+			usingPorts = append(usingPorts, *v)
+		}
+		err = c.Clean(project, name, usingPorts)
+		if err != nil {
+			return drained, err
+		}
+		drained = append(drained, name)
+	}
+	return drained, nil
+}
+
 func (c *Cache) cleanPorts(project, id string, ports []Port) {
 	// 清理端口使用
 	var wg = new(sync.WaitGroup)
@@ -376,8 +655,22 @@ func (c *Cache) cleanBackendSet(project, name string) error {
 	return nil
 }
 
+func excluded(exclude []string, id string) bool {
+	for _, v := range exclude {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// backendMember 后端集合成员, 格式为 name#port#protocol#target_port
+func backendMember(p Port) string {
+	return fmt.Sprintf("%s#%d#%s#%d", p.Name, p.Port, p.Protocol, p.TargetPort)
+}
+
 func (c *Cache) loadBalancerKey(project string, key ...string) string {
-	return c.generateKey(project, "loadbalancer", key...)
+	return c.scopedKey(project, "loadbalancer", key...)
 }
 
 func (c *Cache) backendKey(project string, key ...string) string {
@@ -391,7 +684,15 @@ func (c *Cache) generateKey(project, style string, key ...string) string {
 	return fmt.Sprintf("%s:%s:%s:%s", c.keyPrefix, project, style, strings.Join(key, ":"))
 }
 
-func (c *Cache) Recycle(interval time.Duration, ch chan<- string) {
+// IdleLoadBalancer 已从缓存中移除的空闲LB, 由调用方删除
+type IdleLoadBalancer struct {
+	Project string
+	Pool    string
+	Owner   string
+	ID      string
+}
+
+func (c *Cache) Recycle(interval time.Duration, ch chan<- IdleLoadBalancer) {
 	go func() {
 		ticker := time.Tick(interval * time.Second)
 		for range ticker {
@@ -415,7 +716,7 @@ func (c *Cache) Recycle(interval time.Duration, ch chan<- string) {
 	}()
 }
 
-func (c *Cache) cleanBackendLoadBalancer(wg *sync.WaitGroup, project string, ch chan<- string) {
+func (c *Cache) cleanBackendLoadBalancer(wg *sync.WaitGroup, project string, ch chan<- IdleLoadBalancer) {
 	defer wg.Done()
 	var key = c.backendKey(project)
 	members, err := c.client.HGetAll(c.ctx, key).Result()
@@ -427,13 +728,14 @@ func (c *Cache) cleanBackendLoadBalancer(wg *sync.WaitGroup, project string, ch
 		wg.Add(1)
 		go func(member string) {
 			defer wg.Done()
+			var pool = c.poolOf(project, member)
 			// check
 			var cursor uint64
 			var data []string
 			for {
 				var err error
 				var keys []string
-				keys, cursor, err = c.client.Scan(c.ctx, cursor, c.loadBalancerKey(project, member, "*"), 1000).Result()
+				keys, cursor, err = c.client.Scan(c.ctx, cursor, pool.loadBalancerKey(project, member, "*"), 1000).Result()
 				if err != nil {
 					logrus.Error(err)
 					continue
@@ -447,7 +749,7 @@ func (c *Cache) cleanBackendLoadBalancer(wg *sync.WaitGroup, project string, ch
 				return
 			}
 			// 清理分数
-			err = c.client.ZRem(c.ctx, c.loadBalancerKey(project, "amount"), member).Err()
+			err = c.client.ZRem(c.ctx, pool.loadBalancerKey(project, "amount"), member).Err()
 			if err != nil && err != redis.Nil {
 				logrus.Warning(err)
 			}
@@ -456,7 +758,24 @@ func (c *Cache) cleanBackendLoadBalancer(wg *sync.WaitGroup, project string, ch
 			if err != nil && err != redis.Nil {
 				logrus.Warning(err)
 			}
-			ch <- member
+			// 清理所属的池, 云账号及记录时间
+			owner, err := c.loadBalancerOwner(project, member)
+			if err != nil {
+				logrus.Warning(err)
+			}
+			err = c.client.HDel(c.ctx, c.poolKey(project), member).Err()
+			if err != nil && err != redis.Nil {
+				logrus.Warning(err)
+			}
+			err = c.client.HDel(c.ctx, c.ownerKey(project), member).Err()
+			if err != nil && err != redis.Nil {
+				logrus.Warning(err)
+			}
+			err = c.client.HDel(c.ctx, c.createdKey(project), member).Err()
+			if err != nil && err != redis.Nil {
+				logrus.Warning(err)
+			}
+			ch <- IdleLoadBalancer{Project: project, Pool: pool.pool, Owner: owner, ID: member}
 		}(member)
 	}
 }
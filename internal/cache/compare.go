@@ -1,33 +1,148 @@
 package cache
 
-func ComparePorts(cachePorts, backendPorts []*Port) (result []*Port) {
-	cachePorts = removeDuplicates(cachePorts)
-	backendPorts = removeDuplicates(backendPorts)
-	var e = make([]*Port, len(backendPorts))
-	for k, v := range backendPorts {
-		if !contains(cachePorts, v) {
-			e[k] = v
-			cachePorts = append(cachePorts, v)
-			backendPorts[k] = nil
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrPortsExhausted LB上允许范围内的端口已用尽
+	ErrPortsExhausted = errors.New("ports exhausted")
+	// ErrPortUnavailable 要求保留的端口在LB上已被占用或不允许
+	ErrPortUnavailable = errors.New("pinned port unavailable")
+)
+
+// 外部端口的保留模式
+const (
+	// PinAny 冲突时重新计算
+	PinAny = "any"
+	// PinPrefer 优先保留, 所有LB上都冲突时重新计算
+	PinPrefer = "prefer"
+	// PinStrict 必须保留, 冲突时换其他LB
+	PinStrict = "strict"
+)
+
+// CompareOptions 端口对比选项
+type CompareOptions struct {
+	// Paired 相同端口号的TCP/UDP端口分配相同的外部端口
+	Paired bool
+	// Allowed 端口是否允许分配, 为nil时允许1-65535
+	Allowed func(int32) bool
+	// StrictPrefer prefer模式的端口按strict处理, 用于在各LB中查找可保留的位置
+	StrictPrefer bool
+}
+
+// ComparePorts 按协议对比已使用端口, 冲突或不允许的端口递增直到该协议下可用, 超出上限后从最小端口继续
+// cachePorts 为各协议已使用的端口, 没有可用端口时返回ErrPortsExhausted, 要求保留的端口不可用时返回ErrPortUnavailable
+func ComparePorts(cachePorts map[string][]*Port, backendPorts []*Port, opts CompareOptions) ([]*Port, error) {
+	var allowed = opts.Allowed
+	if allowed == nil {
+		allowed = func(port int32) bool {
+			return port > 0 && port <= maxPort
 		}
 	}
-
-	for k, v := range backendPorts {
-		if v == nil {
+	var used = make(map[string][]*Port)
+	for protocol, ports := range cachePorts {
+		used[protocol] = removeDuplicates(ports)
+	}
+	groups := groupPorts(backendPorts, opts.Paired)
+	var conflicts [][]*Port
+	// 不冲突的端口优先保留
+	for _, group := range groups {
+		if allowed(group[0].Port) && available(used, group, group[0].Port) {
+			used = occupy(used, group)
 			continue
 		}
-		cachePorts, e[k] = Compare(cachePorts, v)
+		if pin := groupPin(group); pin == PinStrict || (pin == PinPrefer && opts.StrictPrefer) {
+			return nil, fmt.Errorf("%w: %s/%s %d", ErrPortUnavailable, group[0].Name, group[0].Protocol, group[0].Port)
+		}
+		conflicts = append(conflicts, group)
 	}
-	return e
+
+	for _, group := range conflicts {
+		port, ok := next(used, group, allowed)
+		if !ok {
+			return nil, fmt.Errorf("%w: no port available for %s/%s", ErrPortsExhausted, group[0].Name, group[0].Protocol)
+		}
+		for _, v := range group {
+			v.Port = port
+		}
+		used = occupy(used, group)
+	}
+	return backendPorts, nil
 }
 
-func Compare(a []*Port, e *Port) ([]*Port, *Port) {
-	if contains(a, e) {
-		e.Port += 1
-		return Compare(a, e)
+// groupPin 组内最严格的保留模式
+func groupPin(group []*Port) string {
+	var pin = PinAny
+	for _, v := range group {
+		switch v.Pin {
+		case PinStrict:
+			return PinStrict
+		case PinPrefer:
+			pin = PinPrefer
+		}
+	}
+	return pin
+}
+
+const maxPort = 65535
+
+// next 从期望端口开始查找下一个允许且未使用的端口
+func next(used map[string][]*Port, group []*Port, allowed func(int32) bool) (int32, bool) {
+	var start = group[0].Port
+	if start <= 0 || start > maxPort {
+		start = 1
+	}
+	for i := int32(0); i < maxPort; i++ {
+		port := (start-1+i)%maxPort + 1
+		if allowed(port) && available(used, group, port) {
+			return port, true
+		}
 	}
-	a = append(a, e)
-	return a, e
+	return 0, false
+}
+
+// groupPorts 需要分配相同外部端口的端口分为一组
+func groupPorts(ports []*Port, paired bool) (groups [][]*Port) {
+	var index = make(map[int32]int)
+	for _, v := range ports {
+		if paired {
+			if k, ok := index[v.Port]; ok && !containsProtocol(groups[k], v.Protocol) {
+				groups[k] = append(groups[k], v)
+				continue
+			}
+			index[v.Port] = len(groups)
+		}
+		groups = append(groups, []*Port{v})
+	}
+	return groups
+}
+
+// available 组内各端口所在协议下端口号均未使用
+func available(used map[string][]*Port, group []*Port, port int32) bool {
+	for _, v := range group {
+		if contains(used[v.Protocol], &Port{Port: port}) {
+			return false
+		}
+	}
+	return true
+}
+
+func occupy(used map[string][]*Port, group []*Port) map[string][]*Port {
+	for _, v := range group {
+		used[v.Protocol] = append(used[v.Protocol], v)
+	}
+	return used
+}
+
+func containsProtocol(s []*Port, protocol string) bool {
+	for _, a := range s {
+		if a.Protocol == protocol {
+			return true
+		}
+	}
+	return false
 }
 
 func removeDuplicates(s []*Port) []*Port {
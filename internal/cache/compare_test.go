@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+)
+
+func ports(protocol string, numbers ...int32) []*Port {
+	var result []*Port
+	for _, v := range numbers {
+		result = append(result, &Port{Protocol: protocol, Port: v})
+	}
+	return result
+}
+
+func pinned(pin string, port *Port) *Port {
+	port.Pin = pin
+	return port
+}
+
+func TestComparePorts(t *testing.T) {
+	var cases = []struct {
+		name    string
+		used    map[string][]*Port
+		backend []*Port
+		opts    CompareOptions
+		want    []int32
+		err     error
+	}{
+		{
+			name:    "no conflict",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: ports("TCP", 8080, 8081),
+			want:    []int32{8080, 8081},
+		},
+		{
+			name:    "conflict increments",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80, 81)},
+			backend: ports("TCP", 80),
+			want:    []int32{82},
+		},
+		{
+			name:    "conflicts do not displace free ports",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: ports("TCP", 80, 81),
+			want:    []int32{82, 81},
+		},
+		{
+			name:    "protocols are independent",
+			used:    map[string][]*Port{"TCP": ports("TCP", 53)},
+			backend: ports("UDP", 53),
+			want:    []int32{53},
+		},
+		{
+			name:    "unpaired tcp and udp allocated separately",
+			used:    map[string][]*Port{"UDP": ports("UDP", 53)},
+			backend: append(ports("TCP", 53), ports("UDP", 53)...),
+			want:    []int32{53, 54},
+		},
+		{
+			name:    "paired group moves together",
+			used:    map[string][]*Port{"UDP": ports("UDP", 53)},
+			backend: append(ports("TCP", 53), ports("UDP", 53)...),
+			opts:    CompareOptions{Paired: true},
+			want:    []int32{54, 54},
+		},
+		{
+			name: "paired group skips ports used by either protocol",
+			used: map[string][]*Port{
+				"TCP": ports("TCP", 53),
+				"UDP": ports("UDP", 54),
+			},
+			backend: append(ports("TCP", 53), ports("UDP", 53)...),
+			opts:    CompareOptions{Paired: true},
+			want:    []int32{55, 55},
+		},
+		{
+			name:    "paired only joins different protocols",
+			backend: ports("TCP", 80, 80),
+			opts:    CompareOptions{Paired: true},
+			want:    []int32{80, 81},
+		},
+		{
+			name:    "wraps to the smallest allowed port",
+			used:    map[string][]*Port{"TCP": ports("TCP", 30002)},
+			backend: ports("TCP", 30002),
+			opts: CompareOptions{Allowed: func(port int32) bool {
+				return port >= 30000 && port <= 30002
+			}},
+			want: []int32{30000},
+		},
+		{
+			name:    "disallowed port is moved",
+			backend: ports("TCP", 22),
+			opts: CompareOptions{Allowed: func(port int32) bool {
+				return port != 22
+			}},
+			want: []int32{23},
+		},
+		{
+			name:    "exhausted",
+			used:    map[string][]*Port{"TCP": ports("TCP", 30000, 30001)},
+			backend: ports("TCP", 30000),
+			opts: CompareOptions{Allowed: func(port int32) bool {
+				return port >= 30000 && port <= 30001
+			}},
+			err: ErrPortsExhausted,
+		},
+		{
+			name:    "strict pinned port unavailable",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: []*Port{pinned(PinStrict, &Port{Protocol: "TCP", Port: 80})},
+			err:     ErrPortUnavailable,
+		},
+		{
+			name:    "strict pinned port not allowed",
+			backend: []*Port{pinned(PinStrict, &Port{Protocol: "TCP", Port: 22})},
+			opts: CompareOptions{Allowed: func(port int32) bool {
+				return port != 22
+			}},
+			err: ErrPortUnavailable,
+		},
+		{
+			name:    "strict pinned port kept",
+			used:    map[string][]*Port{"TCP": ports("TCP", 81)},
+			backend: []*Port{pinned(PinStrict, &Port{Protocol: "TCP", Port: 80})},
+			want:    []int32{80},
+		},
+		{
+			name:    "prefer falls back on conflict",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: []*Port{pinned(PinPrefer, &Port{Protocol: "TCP", Port: 80})},
+			want:    []int32{81},
+		},
+		{
+			name:    "prefer as strict while searching",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: []*Port{pinned(PinPrefer, &Port{Protocol: "TCP", Port: 80})},
+			opts:    CompareOptions{StrictPrefer: true},
+			err:     ErrPortUnavailable,
+		},
+		{
+			name:    "any falls back even while searching",
+			used:    map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: []*Port{pinned(PinAny, &Port{Protocol: "TCP", Port: 80})},
+			opts:    CompareOptions{StrictPrefer: true},
+			want:    []int32{81},
+		},
+		{
+			name: "strict member pins the paired group",
+			used: map[string][]*Port{"UDP": ports("UDP", 53)},
+			backend: []*Port{
+				pinned(PinStrict, &Port{Protocol: "TCP", Port: 53}),
+				{Protocol: "UDP", Port: 53},
+			},
+			opts: CompareOptions{Paired: true},
+			err:  ErrPortUnavailable,
+		},
+		{
+			name: "pinned ports keep their place before conflicts move",
+			used: map[string][]*Port{"TCP": ports("TCP", 80)},
+			backend: []*Port{
+				{Protocol: "TCP", Port: 80},
+				pinned(PinStrict, &Port{Protocol: "TCP", Port: 81}),
+			},
+			want: []int32{82, 81},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := ComparePorts(c.used, c.backend, c.opts)
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("expected %v, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != len(c.want) {
+				t.Fatalf("expected %d ports, got %d", len(c.want), len(result))
+			}
+			for k, v := range result {
+				if v.Port != c.want[k] {
+					t.Errorf("port %d: expected %d, got %d", k, c.want[k], v.Port)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"strconv"
+	"time"
+)
+
+// setCreated 记录LB首次记录到缓存的时间, 已记录时不覆盖
+func (c *Cache) setCreated(project, id string) error {
+	return c.client.HSetNX(c.ctx, c.createdKey(project), id, time.Now().UnixNano()).Err()
+}
+
+// fillCreated 填充候选LB的记录时间, 未记录的为0
+func (c *Cache) fillCreated(project string, candidates []*Candidate) error {
+	var ids []string
+	for _, v := range candidates {
+		ids = append(ids, v.ID)
+	}
+	values, err := c.client.HMGet(c.ctx, c.createdKey(project), ids...).Result()
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		candidates[k].Created, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return nil
+}
+
+// createdKey LB记录到缓存的时间, 不区分池
+func (c *Cache) createdKey(project string) string {
+	return c.generateKey(project, "loadbalancer", "created")
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+)
+
+// GetHealthCheckNodePort 为service在[min, max]范围内选择健康检查端口, 已记录且未被排除的直接返回
+// 健康检查端口在集群内唯一, 不区分项目, exclude为集群中已被占用的端口
+// 只选择不记录, 写入service成功后调用SetHealthCheckNodePort记录
+func (c *Cache) GetHealthCheckNodePort(project, name string, min, max int32, exclude map[int32]bool) (int32, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var key = c.healthCheckKey()
+	var owner = project + "/" + name
+	ports, err := c.client.HGetAll(c.ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	var used = make(map[int32]bool)
+	for k, v := range ports {
+		port, _ := strconv.ParseInt(v, 10, 32)
+		if k == owner {
+			if int32(port) >= min && int32(port) <= max && !exclude[int32(port)] {
+				return int32(port), nil
+			}
+			continue
+		}
+		used[int32(port)] = true
+	}
+	for port := min; port <= max; port++ {
+		if used[port] || exclude[port] {
+			continue
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("no health check node port available in range %d-%d", min, max)
+}
+
+// SetHealthCheckNodePort 记录service已使用的健康检查端口
+func (c *Cache) SetHealthCheckNodePort(project, name string, port int32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client.HSet(c.ctx, c.healthCheckKey(), project+"/"+name, port).Err()
+}
+
+// ReleaseHealthCheckNodePort 释放service的健康检查端口
+func (c *Cache) ReleaseHealthCheckNodePort(project, name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.releaseHealthCheckNodePort(project, name)
+}
+
+func (c *Cache) releaseHealthCheckNodePort(project, name string) error {
+	err := c.client.HDel(c.ctx, c.healthCheckKey(), project+"/"+name).Err()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) healthCheckKey() string {
+	return fmt.Sprintf("%s:health_check_node_port", c.keyPrefix)
+}
@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"enforce-shared-lb/internal/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// SetLoadBalancerOwner 记录LB所属的云账号
+func (c *Cache) SetLoadBalancerOwner(project, id, owner string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client.HSet(c.ctx, c.ownerKey(project), id, owner).Err()
+}
+
+// GetLoadBalancerOwner 获取LB所属的云账号, 未记录时为默认账号
+func (c *Cache) GetLoadBalancerOwner(project, id string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.loadBalancerOwner(project, id)
+}
+
+func (c *Cache) loadBalancerOwner(project, id string) (string, error) {
+	owner, err := c.client.HGet(c.ctx, c.ownerKey(project), id).Result()
+	if err == redis.Nil {
+		return config.DefaultAccount, nil
+	}
+	return owner, err
+}
+
+// ownerKey LB所属的云账号, 不区分池
+func (c *Cache) ownerKey(project string) string {
+	return c.generateKey(project, "loadbalancer", "owner")
+}
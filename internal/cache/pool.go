@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"enforce-shared-lb/internal/config"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Pool 负载均衡器池的视图, 使用量, 端口, 独占, 亲和及反亲和的键按池区分, 后端的键为项目共用
+// 未注册的池使用默认池的最大数量
+func (c *Cache) Pool(name string) *Cache {
+	if name == "" {
+		name = config.DefaultPool
+	}
+	if name == c.pool {
+		return c
+	}
+	max, ok := c.pools[name]
+	if !ok {
+		max = c.pools[config.DefaultPool]
+	}
+	return &Cache{
+		client:           c.client,
+		lock:             c.lock,
+		keyPrefix:        c.keyPrefix,
+		maxNumOfBackends: max,
+		ctx:              c.ctx,
+		pool:             name,
+		pools:            c.pools,
+	}
+}
+
+// AddPool 注册池中每个LB的最大数量, 需在处理事件前调用
+func (c *Cache) AddPool(name string, maxNumOfBackends int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pools[name] = maxNumOfBackends - 1
+	if name == c.pool {
+		c.maxNumOfBackends = maxNumOfBackends - 1
+	}
+}
+
+// GetLoadBalancerPool 获取LB所属的池, 未记录时为默认池
+func (c *Cache) GetLoadBalancerPool(project, id string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.loadBalancerPool(project, id)
+}
+
+func (c *Cache) loadBalancerPool(project, id string) (string, error) {
+	pool, err := c.client.HGet(c.ctx, c.poolKey(project), id).Result()
+	if err == redis.Nil {
+		return config.DefaultPool, nil
+	}
+	return pool, err
+}
+
+// poolOf LB所属池的视图, 查询失败时使用当前视图
+func (c *Cache) poolOf(project, id string) *Cache {
+	pool, err := c.loadBalancerPool(project, id)
+	if err != nil {
+		logrus.Warning(err)
+		return c
+	}
+	return c.Pool(pool)
+}
+
+// poolKey LB所属的池, 不区分池
+func (c *Cache) poolKey(project string) string {
+	return c.generateKey(project, "loadbalancer", "pool")
+}
+
+// scopedKey 按池区分的键, 默认池沿用原有的键
+func (c *Cache) scopedKey(project, style string, key ...string) string {
+	if c.pool != config.DefaultPool {
+		project = fmt.Sprintf("%s:pool:%s", project, c.pool)
+	}
+	return c.generateKey(project, style, key...)
+}
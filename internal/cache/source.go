@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"github.com/go-redis/redis/v8"
+)
+
+// SetBackendSource 记录后端最近一次成功处理的事件来源
+func (c *Cache) SetBackendSource(project, name, source string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client.HSet(c.ctx, c.sourceKey(project), name, source).Err()
+}
+
+// GetBackendSource 获取后端的事件来源, 未记录时为空
+func (c *Cache) GetBackendSource(project, name string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	source, err := c.client.HGet(c.ctx, c.sourceKey(project), name).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return source, err
+}
+
+func (c *Cache) cleanBackendSource(project, name string) error {
+	err := c.client.HDel(c.ctx, c.sourceKey(project), name).Err()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) sourceKey(project string) string {
+	return c.generateKey(project, "source")
+}
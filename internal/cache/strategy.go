@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"sort"
+)
+
+// LB选择策略名称
+const (
+	StrategyFirstFit           = "first-fit"
+	StrategyBestFit            = "best-fit"
+	StrategySpread             = "spread"
+	StrategyLeastPortConflicts = "least-port-conflicts"
+)
+
+// Candidate 可选的LB
+type Candidate struct {
+	ID string
+	// Remain 剩余可用数量
+	Remain int64
+	// Created LB记录到缓存的时间(unix纳秒), 未记录的为0
+	Created int64
+	// Conflicts 需要分配的端口在该LB上已被占用的数量, 只在策略实现ConflictAware时计算
+	Conflicts int
+}
+
+// Strategy LB选择策略
+type Strategy interface {
+	Name() string
+	// Select 从候选LB中选择一个, 候选按剩余量升序排列且不为空
+	Select(candidates []*Candidate) *Candidate
+}
+
+// ConflictAware 可选接口, 选择时需要候选LB上的端口冲突数
+type ConflictAware interface {
+	ConflictAware() bool
+}
+
+var strategies = make(map[string]Strategy)
+
+// RegisterStrategy 注册LB选择策略
+func RegisterStrategy(strategy Strategy) {
+	strategies[strategy.Name()] = strategy
+}
+
+// GetStrategy 按名称获取策略, 名称为空时使用first-fit
+func GetStrategy(name string) (Strategy, bool) {
+	if name == "" {
+		name = StrategyFirstFit
+	}
+	strategy, ok := strategies[name]
+	return strategy, ok
+}
+
+func init() {
+	RegisterStrategy(firstFit{})
+	RegisterStrategy(bestFit{})
+	RegisterStrategy(spread{})
+	RegisterStrategy(leastPortConflicts{})
+}
+
+// firstFit 最早记录的满足的LB, 与剩余量无关, 相同时按ID
+type firstFit struct{}
+
+func (firstFit) Name() string { return StrategyFirstFit }
+
+func (firstFit) Select(candidates []*Candidate) *Candidate {
+	return minCandidate(candidates, func(a, b *Candidate) bool {
+		if a.Created != b.Created {
+			return a.Created < b.Created
+		}
+		return a.ID < b.ID
+	})
+}
+
+// bestFit 剩余量最少的LB, 装箱使LB数量最少
+type bestFit struct{}
+
+func (bestFit) Name() string { return StrategyBestFit }
+
+func (bestFit) Select(candidates []*Candidate) *Candidate {
+	return minCandidate(candidates, func(a, b *Candidate) bool {
+		return a.Remain < b.Remain
+	})
+}
+
+// spread 剩余量最多的LB, 保留最大余量
+type spread struct{}
+
+func (spread) Name() string { return StrategySpread }
+
+func (spread) Select(candidates []*Candidate) *Candidate {
+	return minCandidate(candidates, func(a, b *Candidate) bool {
+		return a.Remain > b.Remain
+	})
+}
+
+// leastPortConflicts 端口需要重新计算最少的LB, 相同时剩余量少的优先
+type leastPortConflicts struct{}
+
+func (leastPortConflicts) Name() string { return StrategyLeastPortConflicts }
+
+func (leastPortConflicts) ConflictAware() bool { return true }
+
+func (leastPortConflicts) Select(candidates []*Candidate) *Candidate {
+	return minCandidate(candidates, func(a, b *Candidate) bool {
+		if a.Conflicts != b.Conflicts {
+			return a.Conflicts < b.Conflicts
+		}
+		return a.Remain < b.Remain
+	})
+}
+
+// minCandidate 按less排序后的第一个, 相同时保持原顺序
+func minCandidate(candidates []*Candidate, less func(a, b *Candidate) bool) *Candidate {
+	var sorted = make([]*Candidate, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	return sorted[0]
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestStrategies(t *testing.T) {
+	// 候选按剩余量升序排列
+	var candidates = []*Candidate{
+		{ID: "lb-c", Remain: 2, Created: 300, Conflicts: 2},
+		{ID: "lb-a", Remain: 5, Created: 200, Conflicts: 0},
+		{ID: "lb-b", Remain: 5, Created: 100, Conflicts: 1},
+		{ID: "lb-d", Remain: 9, Created: 400, Conflicts: 0},
+	}
+	var cases = []struct {
+		strategy   string
+		candidates []*Candidate
+		want       string
+	}{
+		{strategy: StrategyFirstFit, candidates: candidates, want: "lb-b"},
+		{strategy: "", candidates: candidates, want: "lb-b"},
+		{strategy: StrategyBestFit, candidates: candidates, want: "lb-c"},
+		{strategy: StrategySpread, candidates: candidates, want: "lb-d"},
+		{strategy: StrategyLeastPortConflicts, candidates: candidates, want: "lb-a"},
+		{
+			strategy: StrategyFirstFit,
+			candidates: []*Candidate{
+				{ID: "lb-new", Remain: 1, Created: 100},
+				{ID: "lb-old-2", Remain: 3},
+				{ID: "lb-old-1", Remain: 4},
+			},
+			want: "lb-old-1",
+		},
+		{
+			strategy: StrategySpread,
+			candidates: []*Candidate{
+				{ID: "lb-b", Remain: 5},
+				{ID: "lb-a", Remain: 5},
+			},
+			want: "lb-b",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.strategy+"/"+c.want, func(t *testing.T) {
+			strategy, ok := GetStrategy(c.strategy)
+			if !ok {
+				t.Fatalf("strategy %q not registered", c.strategy)
+			}
+			if got := strategy.Select(c.candidates); got.ID != c.want {
+				t.Errorf("expected %s, got %s", c.want, got.ID)
+			}
+		})
+	}
+}
+
+func TestConflictAware(t *testing.T) {
+	for _, name := range []string{StrategyFirstFit, StrategyBestFit, StrategySpread, StrategyLeastPortConflicts} {
+		strategy, _ := GetStrategy(name)
+		aware, ok := strategy.(ConflictAware)
+		if want := name == StrategyLeastPortConflicts; (ok && aware.ConflictAware()) != want {
+			t.Errorf("%s: expected conflict aware %v", name, want)
+		}
+	}
+	if _, ok := GetStrategy("round-robin"); ok {
+		t.Error("expected unknown strategy")
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"github.com/sirupsen/logrus"
+	"sort"
+)
+
+// DefaultAccount 默认云账号, 即cloud中的配置
+const DefaultAccount = "default"
+
+// loadAccounts 校验云账号并生成各账号创建LB的配置
+func (c *Configure) loadAccounts() {
+	for name, account := range c.Accounts {
+		if name == DefaultAccount {
+			logrus.Fatalf("accounts.%s: name is reserved for cloud", name)
+		}
+		if account == nil {
+			logrus.Fatalf("accounts.%s: empty account", name)
+		}
+		if _, ok := CloudConf[account.Name]; !ok {
+			logrus.Fatalf("accounts.%s: %s Cloud Merchant is not supported yet", name, account.Name)
+		}
+		if account.Max <= 0 {
+			account.Max = c.Cloud.Max
+		}
+		conf, err := newCloudConf(account.Name, account.Config)
+		if err != nil {
+			logrus.Fatalf("accounts.%s: %v", name, err)
+		}
+		account.CloudConf = conf
+		if err = checkTrafficPolicies(account.ExternalTrafficPolicies); err != nil {
+			logrus.Fatalf("accounts.%s.external_traffic_policies: %v", name, err)
+		}
+	}
+}
+
+// Account 获取云账号, 不存在时返回nil
+func (c *Configure) Account(name string) *Cloud {
+	if name == "" || name == DefaultAccount {
+		return c.Cloud
+	}
+	return c.Accounts[name]
+}
+
+// AccountNames 全部云账号的名称, 包含默认账号, 按名称排序
+func (c *Configure) AccountNames() []string {
+	var names = []string{DefaultAccount}
+	for name := range c.Accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
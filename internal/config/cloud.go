@@ -2,33 +2,60 @@ package config
 
 import (
 	"enforce-shared-lb/internal/utils"
+	"fmt"
 	aliSlb "github.com/alibabacloud-go/slb-20140515/v3/client"
 	huaweiElb "github.com/huaweicloud/huaweicloud-sdk-go-v3/services/elb/v2/model"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
 	tencentClb "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/clb/v20180317"
+	corev1 "k8s.io/api/core/v1"
 	"strings"
 )
 
 func (c *Configure) loadCloudConf() {
-	if c.Labels == nil {
-		c.Labels = map[string]string{
-			"lb_address_type": "internet",
-			"q1autoops_type":  "game-service",
-		}
-	}
 	if strings.HasSuffix(c.KeyPrefix, ":") {
 		c.KeyPrefix = strings.TrimSuffix(c.KeyPrefix, ":")
 	}
 
-	var ok bool
-	c.CloudConf, ok = CloudConf[c.Cloud.Name]
-	if !ok {
+	if _, ok := CloudConf[c.Cloud.Name]; !ok {
 		logrus.Fatalf("%s Cloud Merchant is not supported yet", c.Cloud.Name)
 	}
-	err := utils.Json.Unmarshal(c.Cloud.Config, c.CloudConf)
+	var err error
+	c.CloudConf, err = newCloudConf(c.Cloud.Name, c.Cloud.Config)
 	if err != nil {
 		logrus.Fatalln(err)
 	}
+	c.Cloud.CloudConf = c.CloudConf
+	if err = checkTrafficPolicies(c.Cloud.ExternalTrafficPolicies); err != nil {
+		logrus.Fatalf("cloud.external_traffic_policies: %v", err)
+	}
+}
+
+// checkTrafficPolicies 外部流量策略只能为Local或Cluster
+func checkTrafficPolicies(policies []string) error {
+	for _, v := range policies {
+		switch corev1.ServiceExternalTrafficPolicyType(v) {
+		case corev1.ServiceExternalTrafficPolicyTypeLocal, corev1.ServiceExternalTrafficPolicyTypeCluster:
+		default:
+			return fmt.Errorf("invalid traffic policy %q", v)
+		}
+	}
+	return nil
+}
+
+// newCloudConf 按顺序解析创建LB的配置, 后面的配置覆盖前面的同名字段
+func newCloudConf(name string, configs ...jsoniter.RawMessage) (interface{}, error) {
+	var conf = CloudConf[name]()
+	for _, v := range configs {
+		if len(v) == 0 {
+			continue
+		}
+		err := utils.Json.Unmarshal(v, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
 }
 
 const (
@@ -38,11 +65,12 @@ const (
 	TencentCloud = "tencent"
 )
 
-var CloudConf = map[string]interface{}{
-	FakeCloud:    new(AlibabaConf),
-	AlibabaCloud: new(AlibabaConf),
-	HuaweiCloud:  new(HuaweiConf),
-	TencentCloud: new(TencentConf),
+// CloudConf 各云厂商创建LB的配置类型
+var CloudConf = map[string]func() interface{}{
+	FakeCloud:    func() interface{} { return new(AlibabaConf) },
+	AlibabaCloud: func() interface{} { return new(AlibabaConf) },
+	HuaweiCloud:  func() interface{} { return new(HuaweiConf) },
+	TencentCloud: func() interface{} { return new(TencentConf) },
 }
 
 type AlibabaConf struct {
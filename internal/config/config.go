@@ -5,6 +5,8 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"os"
 )
 
@@ -15,12 +17,39 @@ type Configure struct {
 	Port        int64             `json:"port" default:"8080"`
 	AutoClean   bool              `json:"auto_clean" default:"false"`
 	ChannelSize int               `json:"channel_size" default:"1024"`
+	Resync      int64             `json:"resync" default:"300"`
+	Workers     int               `json:"workers" default:"8"`
+	Reconcile   int64             `json:"reconcile" default:"600"`
 	Redis       string            `json:"redis" default:"redis://:123456@localhost:6379/0"`
 	KeyPrefix   string            `json:"key_prefix" default:"enforce_shared_lb"`
 	Labels      map[string]string `json:"labels" default:"lb_address_type:internet,q1autoops_type:game-service"`
-	Cloud       *Cloud            `json:"cloud"`
+	// ExternalTrafficPolicy 转换后service默认的外部流量策略, Local 或 Cluster
+	ExternalTrafficPolicy string `json:"external_traffic_policy" default:"Local"`
+	// HealthCheckNodePort 外部流量策略为Local时在此范围内固定分配健康检查端口, 未配置时由集群分配
+	HealthCheckNodePort *PortRange `json:"health_check_node_port"`
+	// ServiceNodePortRange 集群的NodePort范围, 与api server的--service-node-port-range一致, 健康检查端口范围需在其中
+	ServiceNodePortRange *PortRange `json:"service_node_port_range"`
+	// Strategy LB选择策略 first-fit, best-fit, spread 或 least-port-conflicts
+	Strategy string `json:"strategy" default:"first-fit"`
+	// Quota 每个项目默认的配额
+	Quota *Quota `json:"quota"`
+	// Projects 按项目覆盖的配置
+	Projects map[string]*Project `json:"projects"`
+	// Ports 允许分配的外部端口范围及保留端口
+	Ports *PortPolicy `json:"ports"`
+	// Pools 命名的负载均衡器池, service按注解或标签选择, 各池使用独立的LB
+	Pools map[string]*Pool `json:"pools"`
+	// Accounts 其他云账号及地域, 键为账号名称, 池通过account使用, cloud为默认账号
+	Accounts map[string]*Cloud `json:"accounts"`
+	// Selectors 完整的标签选择器, 与labels之间为或关系
+	Selectors  []*metav1.LabelSelector `json:"selectors"`
+	Namespaces *Namespaces             `json:"namespaces"`
+	Queue      *Queue                  `json:"queue"`
+	Cloud      *Cloud                  `json:"cloud"`
+	RabbitMQ   *RabbitMQ               `json:"rabbitmq"`
 	// 预留自用
-	CloudConf interface{} `json:"-"`
+	CloudConf interface{}       `json:"-"`
+	selectors []labels.Selector `json:"-"`
 }
 
 type Cloud struct {
@@ -30,20 +59,81 @@ type Cloud struct {
 	AccessKeyId     *string             `json:"access_key_id" default:""`
 	AccessKeySecret *string             `json:"access_key_secret" default:""`
 	Config          jsoniter.RawMessage `json:"config"`
+	// ExternalTrafficPolicies 该账号在集群中的云控制器支持的外部流量策略, 为空时为云厂商支持的全部策略
+	ExternalTrafficPolicies []string `json:"external_traffic_policies"`
+	// 预留自用
+	CloudConf interface{} `json:"-"`
+}
+
+// PortRange 端口范围, 包含min和max
+type PortRange struct {
+	Min int32 `json:"min"`
+	Max int32 `json:"max"`
+}
+
+// Namespaces 命名空间范围, include为空时为全部命名空间, selector按命名空间标签选择
+// kube-system等系统命名空间始终排除
+type Namespaces struct {
+	Include  []string              `json:"include"`
+	Exclude  []string              `json:"exclude"`
+	Selector *metav1.LabelSelector `json:"selector"`
+}
+
+// Queue 事件队列, 失败的事件按键指数退避重试, 延迟单位为秒
+type Queue struct {
+	MaxRetries int   `json:"max_retries" default:"10"`
+	BaseDelay  int64 `json:"base_delay" default:"1"`
+	MaxDelay   int64 `json:"max_delay" default:"300"`
+}
+
+// RabbitMQ 事件来源, url为空时不启用
+type RabbitMQ struct {
+	Url          string `json:"url" default:""`
+	Exchange     string `json:"exchange" default:""`
+	ExchangeType string `json:"exchange_type" default:"topic"`
+	RoutingKey   string `json:"routing_key" default:"#"`
+	Queue        string `json:"queue" default:"enforce_shared_lb"`
+	Prefetch     int    `json:"prefetch" default:"16"`
+	// DeadLetterExchange 无法处理的消息转发到的死信交换机, 为空时直接丢弃
+	DeadLetterExchange string `json:"dead_letter_exchange" default:""`
 }
 
 var (
 	Conf = &Configure{
-		Addr:        "0.0.0.0",                          //default 0.0.0.0
-		Port:        8080,                               // default 8080
-		ChannelSize: 409600,                             //default 409600
-		Redis:       "redis://:123456@localhost:6379/0", // default "redis://:123456@localhost:6379/0"
-		KeyPrefix:   "enforce_shared_lb",                // default enforce_shared_lb
-		Cloud:       new(Cloud),
+		Addr:                  "0.0.0.0",                          //default 0.0.0.0
+		Port:                  8080,                               // default 8080
+		ChannelSize:           409600,                             //default 409600
+		Resync:                300,                                // default 300s
+		Workers:               8,                                  // default 8
+		Reconcile:             600,                                // default 600s
+		Redis:                 "redis://:123456@localhost:6379/0", // default "redis://:123456@localhost:6379/0"
+		KeyPrefix:             "enforce_shared_lb",                // default enforce_shared_lb
+		ExternalTrafficPolicy: "Local",                            // default Local
+		Strategy:              "first-fit",                        // default first-fit
+		Queue: &Queue{
+			MaxRetries: 10,  // default 10
+			BaseDelay:  1,   // default 1s
+			MaxDelay:   300, // default 300s
+		},
+		Namespaces: new(Namespaces),
+		Cloud:      new(Cloud),
+		ServiceNodePortRange: &PortRange{
+			Min: 30000, // default 30000
+			Max: 32767, // default 32767
+		},
 	}
 	path = kingpin.Flag("config", "Configure file path").Short('c').Default("config.json").String()
 )
 
+// Load 校验配置, 编译标签选择器并生成各账号及池创建LB的配置
+func (c *Configure) Load() {
+	c.loadCloudConf()
+	c.loadSelectors()
+	c.loadPorts()
+	c.loadAccounts()
+	c.loadPools()
+}
+
 // Init config.
 func Init() {
 	file, err := os.ReadFile(*path)
@@ -54,7 +144,7 @@ func Init() {
 	if err != nil {
 		logrus.Fatalln(err)
 	}
-	Conf.loadCloudConf()
+	Conf.Load()
 
 	// init redis
 	err = Conf.newRedisClient()
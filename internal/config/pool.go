@@ -0,0 +1,120 @@
+package config
+
+import (
+	jsoniter "github.com/json-iterator/go"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sort"
+)
+
+// DefaultPool 默认负载均衡器池, 使用cloud中的配置
+const DefaultPool = "default"
+
+// Pool 负载均衡器池, 如公网和内网的LB分别放在不同的池中, 未配置的项使用全局配置
+type Pool struct {
+	// Account 创建LB使用的云账号, 为空时使用cloud
+	Account string `json:"account"`
+	// Max 每个LB的最大端口数, 为0时使用账号的max
+	Max int64 `json:"max"`
+	// Config 创建LB的参数, 覆盖账号config中的同名字段
+	Config jsoniter.RawMessage `json:"config"`
+	// Selector service标签匹配时使用该池, 注解指定的池优先
+	Selector *metav1.LabelSelector `json:"selector"`
+	// Annotations 使用该池的service附加的注解
+	Annotations map[string]string `json:"annotations"`
+	Ports       *PortPolicy       `json:"ports"`
+	// 预留自用
+	CloudConf interface{}     `json:"-"`
+	selector  labels.Selector `json:"-"`
+}
+
+// loadPools 补全池的默认值, 编译标签选择器并生成创建LB的配置
+func (c *Configure) loadPools() {
+	for name, pool := range c.Pools {
+		if pool == nil {
+			pool = new(Pool)
+			c.Pools[name] = pool
+		}
+		account := c.Account(pool.Account)
+		if account == nil {
+			logrus.Fatalf("pools.%s: unknown account %q", name, pool.Account)
+		}
+		if pool.Max <= 0 {
+			pool.Max = account.Max
+		}
+		if pool.Selector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(pool.Selector)
+			if err != nil {
+				logrus.Fatalf("pools.%s: invalid label selector: %v", name, err)
+			}
+			pool.selector = selector
+		}
+		conf, err := newCloudConf(account.Name, account.Config, pool.Config)
+		if err != nil {
+			logrus.Fatalf("pools.%s: %v", name, err)
+		}
+		pool.CloudConf = conf
+	}
+}
+
+// PoolNames 全部池的名称, 包含默认池, 按名称排序
+func (c *Configure) PoolNames() []string {
+	var names = []string{DefaultPool}
+	for name := range c.Pools {
+		if name != DefaultPool {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// HasPool 池是否存在
+func (c *Configure) HasPool(name string) bool {
+	_, ok := c.Pools[name]
+	return ok || name == DefaultPool
+}
+
+// MatchPool 按service标签选择池, 多个池匹配时按名称顺序取第一个, 都不匹配时使用默认池
+func (c *Configure) MatchPool(set map[string]string) string {
+	for _, name := range c.PoolNames() {
+		pool := c.Pools[name]
+		if pool != nil && pool.selector != nil && pool.selector.Matches(labels.Set(set)) {
+			return name
+		}
+	}
+	return DefaultPool
+}
+
+// PoolMax 池中每个LB的最大端口数
+func (c *Configure) PoolMax(name string) int64 {
+	if pool, ok := c.Pools[name]; ok {
+		return pool.Max
+	}
+	return c.Cloud.Max
+}
+
+// PoolCloudConf 池创建LB的配置
+func (c *Configure) PoolCloudConf(name string) interface{} {
+	if pool, ok := c.Pools[name]; ok {
+		return pool.CloudConf
+	}
+	return c.CloudConf
+}
+
+// PoolAccount 池创建LB使用的云账号
+func (c *Configure) PoolAccount(name string) string {
+	if pool, ok := c.Pools[name]; ok && pool.Account != "" {
+		return pool.Account
+	}
+	return DefaultAccount
+}
+
+// PoolAnnotations 使用池的service附加的注解
+func (c *Configure) PoolAnnotations(name string) map[string]string {
+	if pool, ok := c.Pools[name]; ok {
+		return pool.Annotations
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// PortPolicy 允许分配的外部端口范围及保留端口, ranges为空时为1-65535
+type PortPolicy struct {
+	Ranges   []PortRange `json:"ranges"`
+	Reserved []int32     `json:"reserved"`
+}
+
+// loadPorts 校验端口范围配置
+func (c *Configure) loadPorts() {
+	var policies = []*PortPolicy{c.Ports}
+	for _, pool := range c.Pools {
+		if pool != nil {
+			policies = append(policies, pool.Ports)
+		}
+	}
+	for _, policy := range policies {
+		if policy == nil {
+			continue
+		}
+		for _, r := range policy.Ranges {
+			if r.Min <= 0 || r.Max > 65535 || r.Min > r.Max {
+				logrus.Fatalf("invalid port range %d-%d", r.Min, r.Max)
+			}
+		}
+	}
+}
+
+// PortPolicy 获取池的端口配置, 池未配置时使用全局配置
+func (c *Configure) PortPolicy(pool string) *PortPolicy {
+	if p, ok := c.Pools[pool]; ok && p != nil && p.Ports != nil {
+		return p.Ports
+	}
+	return c.Ports
+}
+
+// Allowed 端口是否在允许范围内且未被保留
+func (p *PortPolicy) Allowed(port int32) bool {
+	if port <= 0 || port > 65535 {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+	for _, v := range p.Reserved {
+		if v == port {
+			return false
+		}
+	}
+	if len(p.Ranges) == 0 {
+		return true
+	}
+	for _, r := range p.Ranges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package config
+
+// Project 按项目(命名空间)覆盖的配置, 未配置的项使用全局配置
+type Project struct {
+	Strategy string `json:"strategy"`
+	Quota    *Quota `json:"quota"`
+}
+
+// Quota 项目配额, 0为不限制
+type Quota struct {
+	// LoadBalancers 负载均衡器数量
+	LoadBalancers int64 `json:"loadbalancers"`
+	// Ports 已分配的端口总数
+	Ports int64 `json:"ports"`
+}
+
+// ProjectStrategy 获取项目的LB选择策略
+func (c *Configure) ProjectStrategy(project string) string {
+	if p, ok := c.Projects[project]; ok && p != nil && p.Strategy != "" {
+		return p.Strategy
+	}
+	return c.Strategy
+}
+
+// ProjectQuota 获取项目的配额, 项目未配置的项使用全局配额
+func (c *Configure) ProjectQuota(project string) Quota {
+	var quota Quota
+	if c.Quota != nil {
+		quota = *c.Quota
+	}
+	if p, ok := c.Projects[project]; ok && p != nil && p.Quota != nil {
+		if p.Quota.LoadBalancers != 0 {
+			quota.LoadBalancers = p.Quota.LoadBalancers
+		}
+		if p.Quota.Ports != 0 {
+			quota.Ports = p.Quota.Ports
+		}
+	}
+	return quota
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// loadSelectors 编译labels及selectors, 多个选择器之间为或关系
+func (c *Configure) loadSelectors() {
+	if c.Labels == nil && len(c.Selectors) == 0 {
+		c.Labels = map[string]string{
+			"lb_address_type": "internet",
+			"q1autoops_type":  "game-service",
+		}
+	}
+	var list []*metav1.LabelSelector
+	if len(c.Labels) > 0 {
+		list = append(list, &metav1.LabelSelector{MatchLabels: c.Labels})
+	}
+	list = append(list, c.Selectors...)
+	c.selectors = nil
+	for _, v := range list {
+		if v == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(v)
+		if err != nil {
+			logrus.Fatalf("invalid label selector: %v", err)
+		}
+		c.selectors = append(c.selectors, selector)
+	}
+}
+
+// MatchLabels 是否匹配任一选择器
+func (c *Configure) MatchLabels(set map[string]string) bool {
+	for _, selector := range c.selectors {
+		if selector.Matches(labels.Set(set)) {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelSelectors 各选择器的字符串形式, 用于下推到ListOptions由api server过滤
+func (c *Configure) LabelSelectors() []string {
+	var result []string
+	for _, selector := range c.selectors {
+		result = append(result, selector.String())
+	}
+	return result
+}
@@ -4,5 +4,8 @@ type Event struct {
 	BindType  string      `json:"bind_type"`
 	EventType string      `json:"event_type"`
 	Project   string      `json:"project"`
+	Name      string      `json:"name"`
 	Data      interface{} `json:"data"`
+	// Done 处理完成后回传结果, 为空时不回传
+	Done chan error `json:"-"`
 }
@@ -0,0 +1,190 @@
+package namespace
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
+)
+
+// protected 系统命名空间, 始终不处理
+var protected = map[string]bool{
+	metav1.NamespaceSystem:    true,
+	metav1.NamespacePublic:    true,
+	corev1.NamespaceNodeLease: true,
+}
+
+// Scope 命名空间范围, 决定哪些命名空间下的service会被监听和分配
+type Scope struct {
+	client   *kubernetes.Clientset
+	include  map[string]bool
+	exclude  map[string]bool
+	selector labels.Selector
+	informer toolscache.SharedIndexInformer
+	lock     *sync.RWMutex
+	// matched 标签匹配selector的命名空间
+	matched map[string]bool
+	// release 移出范围时还原项目下的service并释放分配, 未设置时只释放缓存中的分配
+	release func(project string) ([]string, error)
+}
+
+var S *Scope
+
+func New() {
+	var conf = config.Conf.Namespaces
+	S = &Scope{
+		client:  config.KubeClient,
+		include: make(map[string]bool),
+		exclude: make(map[string]bool),
+		lock:    new(sync.RWMutex),
+		matched: make(map[string]bool),
+	}
+	if conf == nil {
+		return
+	}
+	for _, v := range conf.Include {
+		S.include[v] = true
+	}
+	for _, v := range conf.Exclude {
+		S.exclude[v] = true
+	}
+	if conf.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(conf.Selector)
+		if err != nil {
+			logrus.Fatalf("invalid namespace selector: %v", err)
+		}
+		S.selector = selector
+	}
+}
+
+// Start 按selector监听命名空间, 命名空间移出范围时释放其项目在缓存中的分配, 同步完成后返回
+func (s *Scope) Start(ctx context.Context) error {
+	if s.selector == nil {
+		return nil
+	}
+	if s.client == nil {
+		return fmt.Errorf("namespace selector requires kubernetes client")
+	}
+	factory := informers.NewSharedInformerFactory(s.client, time.Duration(config.Conf.Resync)*time.Second)
+	s.informer = factory.Core().V1().Namespaces().Informer()
+	_, err := s.informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.update(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			s.update(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ns, ok := obj.(*corev1.Namespace); ok {
+				s.remove(ns.Name)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	go s.informer.Run(ctx.Done())
+	if !toolscache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		return fmt.Errorf("namespace informer sync canceled")
+	}
+	logrus.Infoln("namespace informer synced")
+	return nil
+}
+
+func (s *Scope) update(obj interface{}) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	if s.selector.Matches(labels.Set(ns.Labels)) {
+		s.lock.Lock()
+		s.matched[ns.Name] = true
+		s.lock.Unlock()
+		return
+	}
+	s.remove(ns.Name)
+}
+
+// remove 命名空间不再匹配selector
+func (s *Scope) remove(name string) {
+	s.lock.Lock()
+	matched := s.matched[name]
+	delete(s.matched, name)
+	s.lock.Unlock()
+	if matched {
+		go func() {
+			drained, err := Drain(name)
+			if err != nil {
+				logrus.Errorf("drain project %s failed: %v", name, err)
+			}
+			logrus.Infof("namespace %s out of scope, drained backends %v", name, drained)
+		}()
+	}
+}
+
+// SetRelease 设置移出范围时还原service的方法, 需在处理事件前调用
+func (s *Scope) SetRelease(release func(project string) ([]string, error)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release = release
+}
+
+// HasSynced 命名空间是否已同步, 未配置selector时始终为true
+func (s *Scope) HasSynced() bool {
+	if s.informer == nil {
+		return s.selector == nil
+	}
+	return s.informer.HasSynced()
+}
+
+// Allowed 命名空间是否在处理范围内
+func (s *Scope) Allowed(name string) bool {
+	if protected[name] || s.exclude[name] {
+		return false
+	}
+	if len(s.include) > 0 && !s.include[name] {
+		return false
+	}
+	if s.selector != nil {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.matched[name]
+	}
+	return true
+}
+
+// Watched 需要监听的命名空间, 为空时监听全部命名空间
+func (s *Scope) Watched() []string {
+	var result []string
+	for name := range s.include {
+		if protected[name] || s.exclude[name] {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+// Drain 还原项目下仍绑定LB的service并释放项目在缓存中的全部分配, 返回已释放的后端名称
+// 只释放缓存会使仍在使用的LB被自动清理, 且命名空间恢复后service因缓存中没有记录无法再处理
+func Drain(project string) ([]string, error) {
+	S.lock.RLock()
+	release := S.release
+	S.lock.RUnlock()
+	if release != nil {
+		return release(project)
+	}
+	return cache.DB.DrainProject(project)
+}
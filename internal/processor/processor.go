@@ -5,49 +5,77 @@ import (
 	"enforce-shared-lb/internal/cache"
 	"enforce-shared-lb/internal/config"
 	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
+	"enforce-shared-lb/internal/processor/reconcile"
 	"enforce-shared-lb/internal/processor/service"
-	"enforce-shared-lb/internal/provider"
 	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/queue"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"time"
 )
 
 type consumer struct {
-	conf    *config.Configure
-	service *service.Service
-	lb      provider.LoadBalancerInterface
+	conf     *config.Configure
+	service  *service.Service
+	accounts loadbalancer.Accounts
 }
 
-func Consumer(ctx context.Context, objCh chan model.Event) error {
-	lb, err := loadbalancer.New()
+func Consumer(ctx context.Context, q *queue.Queue) error {
+	accounts, err := loadbalancer.NewAccounts()
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	pools, err := loadbalancer.NewPools()
 	if err != nil {
 		logrus.Error(err)
 		return err
 	}
 	var c = &consumer{
-		conf:    config.Conf,
-		service: service.New(),
-		lb:      lb,
+		conf:     config.Conf,
+		service:  service.New(),
+		accounts: accounts,
+	}
+	c.service.Accounts = accounts
+	c.service.Pools = pools
+	err = c.service.Validate()
+	if err != nil {
+		logrus.Error(err)
+		return err
 	}
-	c.service.LB = lb
+	// 命名空间移出范围时先还原service再释放分配
+	namespace.S.SetRelease(c.service.ReleaseProject)
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logrus.Infoln("stop Consumer")
-				return
-			case obj := <-objCh:
-				c.event(objCh, obj)
+	// 队列保证同一个service不会被并发处理
+	var workers = c.conf.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			for {
+				obj, shutdown := q.Get()
+				if shutdown {
+					logrus.Infof("stop Consumer worker %d", i)
+					return
+				}
+				c.event(q, obj)
 			}
-		}
-	}()
+		}(i)
+	}
+	// 启动时及周期性全量对账
+	reconcile.New(accounts, q)
+	if reconcile.R != nil {
+		go reconcile.R.Start(ctx, time.Duration(c.conf.Reconcile)*time.Second)
+	}
 	if c.conf.AutoClean {
-		ch := make(chan string, c.conf.ChannelSize)
+		ch := make(chan cache.IdleLoadBalancer, c.conf.ChannelSize)
 		cache.DB.Recycle(300, ch)
 		go func() {
-			for id := range ch {
-				logrus.Infoln("clean idle loadBalancer", id)
-				err = c.service.LB.Delete(id)
+			for idle := range ch {
+				logrus.Infof("clean idle loadBalancer %s in pool %s of account %s", idle.ID, idle.Pool, idle.Owner)
+				err := c.accounts.Get(idle.Owner).Delete(idle.ID)
 				if err != nil {
 					logrus.Error(err)
 				}
@@ -57,15 +85,21 @@ func Consumer(ctx context.Context, objCh chan model.Event) error {
 	return nil
 }
 
-func (c *consumer) event(objCh chan model.Event, obj model.Event) {
+func (c *consumer) event(q *queue.Queue, obj model.Event) {
+	var err error
 	switch obj.BindType {
-	case model.Service:
-		// asynchronously process service event
-		c.service.RetryProcess(objCh, obj)
-	case model.Http:
-		logrus.Info(obj.Data)
+	case model.Service, model.Http, model.RabbitMQ:
+		err = c.service.Process(obj)
 	default:
 		logrus.Warningf("source %s is not supported", obj.BindType)
-		return
+	}
+	if err != nil {
+		logrus.Errorf("process %s failed: %v", queue.Key(obj), err)
+	}
+	if !q.Done(obj, err) {
+		logrus.Errorf("process %s failed after %d retries, dropped", queue.Key(obj), c.conf.Queue.MaxRetries)
+		svc, _ := obj.Data.(*corev1.Service)
+		c.service.Eventf(svc, corev1.EventTypeWarning, service.ReasonRetriesExhausted,
+			"giving up after %d retries: %v", c.conf.Queue.MaxRetries, err)
 	}
 }
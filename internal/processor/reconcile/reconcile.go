@@ -0,0 +1,227 @@
+package reconcile
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/queue"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"time"
+)
+
+// Reconciler 全量对账集群中的Service与缓存中的分配状态
+type Reconciler struct {
+	// Accounts 各云账号的客户端, 用于识别service上的LB注解
+	Accounts loadbalancer.Accounts
+	conf     *config.Configure
+	client   kubernetes.Interface
+	queue    *queue.Queue
+	lock     *sync.Mutex
+	last     *Report
+}
+
+// Report 对账结果
+type Report struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Services  int       `json:"services"`
+	Backends  int       `json:"backends"`
+	Allocated []string  `json:"allocated"`
+	Released  []string  `json:"released"`
+	Errors    []string  `json:"errors"`
+}
+
+var R *Reconciler
+
+func New(accounts loadbalancer.Accounts, q *queue.Queue) {
+	if config.KubeClient == nil {
+		return
+	}
+	R = &Reconciler{
+		Accounts: accounts,
+		conf:     config.Conf,
+		client:   config.KubeClient,
+		queue:    q,
+		lock:     new(sync.Mutex),
+	}
+}
+
+// Start 启动时对账一次, 之后按间隔周期对账, 间隔为0时只执行一次
+func (r *Reconciler) Start(ctx context.Context, interval time.Duration) {
+	r.Run(ctx)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Run(ctx)
+		}
+	}
+}
+
+// Last 最近一次对账结果
+func (r *Reconciler) Last() *Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.last
+}
+
+// Run 执行一次对账, 缺失的分配投递到队列, 已不存在的service释放其端口及后端
+func (r *Reconciler) Run(ctx context.Context) *Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var report = &Report{
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+		r.last = report
+		logrus.Infof("reconcile finished in %s, services %d, backends %d, allocated %d, released %d, errors %d",
+			report.Duration, report.Services, report.Backends, len(report.Allocated), len(report.Released), len(report.Errors))
+	}()
+
+	services, err := r.listServices(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	var matched = make(map[string]bool)
+	for _, service := range services {
+		key := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+		matched[key] = true
+		report.Services++
+		if r.allocate(service) {
+			report.Allocated = append(report.Allocated, key)
+		}
+	}
+
+	projects, err := cache.DB.GetProjects()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	for _, project := range projects {
+		// 移出范围的命名空间释放全部分配
+		if !namespace.S.Allowed(project) {
+			drained, err := namespace.Drain(project)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", project, err))
+			}
+			for _, name := range drained {
+				report.Released = append(report.Released, fmt.Sprintf("%s/%s", project, name))
+			}
+			continue
+		}
+		backends, err := cache.DB.GetBackends(project)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		for name := range backends {
+			report.Backends++
+			key := fmt.Sprintf("%s/%s", project, name)
+			if matched[key] {
+				continue
+			}
+			released, err := r.release(ctx, project, name)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			if released {
+				report.Released = append(report.Released, key)
+			}
+		}
+	}
+	return report
+}
+
+// listServices 按各标签选择器列出service并去重
+func (r *Reconciler) listServices(ctx context.Context) ([]*corev1.Service, error) {
+	var result []*corev1.Service
+	var seen = make(map[string]bool)
+	for _, selector := range r.conf.LabelSelectors() {
+		services, err := r.client.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for k := range services.Items {
+			service := &services.Items[k]
+			if !namespace.S.Allowed(service.Namespace) {
+				continue
+			}
+			key := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, service)
+		}
+	}
+	return result, nil
+}
+
+// allocate 尚未分配或未应用到service的投递到队列
+func (r *Reconciler) allocate(service *corev1.Service) bool {
+	id, _ := cache.DB.GetBackendPorts(service.Namespace, service.Name)
+	var eventType string
+	switch {
+	case id == "" && service.Spec.Type == corev1.ServiceTypeClusterIP:
+		eventType = model.EventTypeAdded
+	case id != "" && (service.Spec.Type != corev1.ServiceTypeLoadBalancer || !r.Accounts.CheckAnnotation(service.Annotations)):
+		eventType = model.EventTypeModified
+	default:
+		return false
+	}
+	r.queue.Add(model.Event{
+		BindType:  model.Service,
+		EventType: eventType,
+		Project:   service.Namespace,
+		Name:      service.Name,
+		Data:      service,
+	})
+	return true
+}
+
+// release 来自集群监听的service已不存在时释放其占用的端口及后端
+// 来自http或rabbitmq的service可能尚未在集群中创建, 保留其分配, 由删除事件释放
+// 未记录来源的后端(记录来源之前的分配)视为来自集群监听
+func (r *Reconciler) release(ctx context.Context, project, name string) (bool, error) {
+	source, err := cache.DB.GetBackendSource(project, name)
+	if err != nil {
+		return false, err
+	}
+	if source != "" && source != model.Service {
+		return false, nil
+	}
+	_, err = r.client.CoreV1().Services(project).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return false, nil
+	}
+	if !errors.IsNotFound(err) {
+		return false, err
+	}
+	_, ports := cache.DB.GetBackendPorts(project, name)
+	var usingPorts []cache.Port
+	for _, v := range ports {
+		usingPorts = append(usingPorts, *v)
+	}
+	logrus.Infof("release orphaned backend %s/%s", project, name)
+	return true, cache.DB.Clean(project, name, usingPorts)
+}
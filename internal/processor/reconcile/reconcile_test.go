@@ -0,0 +1,151 @@
+package reconcile
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/provider/loadbalancer/fake"
+	"enforce-shared-lb/internal/queue"
+	"enforce-shared-lb/internal/utils"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestReconciler 使用miniredis及集群中的objects创建Reconciler, 每个LB最多3个端口, data为覆盖的配置
+func newTestReconciler(t *testing.T, data string, objects ...runtime.Object) *Reconciler {
+	t.Helper()
+	var conf = &config.Configure{
+		KeyPrefix:             "test",
+		ExternalTrafficPolicy: string(corev1.ServiceExternalTrafficPolicyTypeCluster),
+		Strategy:              "first-fit",
+		Namespaces:            new(config.Namespaces),
+		Cloud:                 &config.Cloud{Name: config.FakeCloud, Max: 4},
+	}
+	if data != "" {
+		if err := utils.Json.Unmarshal([]byte(data), conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf.Load()
+	saved := config.Conf
+	config.Conf = conf
+	t.Cleanup(func() {
+		config.Conf = saved
+	})
+	namespace.New()
+
+	mr := miniredis.RunT(t)
+	cache.New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), conf.KeyPrefix, conf.Cloud.Max)
+	return &Reconciler{
+		Accounts: loadbalancer.Accounts{config.DefaultAccount: fake.New()},
+		conf:     conf,
+		client:   k8sfake.NewSimpleClientset(objects...),
+		lock:     new(sync.Mutex),
+	}
+}
+
+// boundService 已绑定LB的service, id为空时未绑定
+func boundService(name, id string, annotations map[string]string, ports ...int32) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels: map[string]string{
+				"lb_address_type": "internet",
+				"q1autoops_type":  "game-service",
+			},
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+		},
+	}
+	for k, v := range annotations {
+		service.Annotations[k] = v
+	}
+	if id != "" {
+		fake.New().Annotation(id, service.Annotations)
+	}
+	for _, v := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: v})
+	}
+	return service
+}
+
+// 集群中已不存在的service释放其分配, 未记录来源的视为来自集群监听, 来自http的保留
+func TestRunReleasesOrphans(t *testing.T) {
+	r := newTestReconciler(t, "")
+	for _, name := range []string{"cluster", "unknown", "http"} {
+		if err := cache.DB.AddBackend("default", name, "lb-1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.DB.AddProject("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.DB.SetBackendSource("default", "cluster", model.Service); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.DB.SetBackendSource("default", "http", model.Http); err != nil {
+		t.Fatal(err)
+	}
+	report := r.Run(context.Background())
+	sort.Strings(report.Released)
+	if want := []string{"default/cluster", "default/unknown"}; !reflect.DeepEqual(report.Released, want) {
+		t.Fatalf("expected released %v, got %v", want, report.Released)
+	}
+	backends, err := cache.DB.GetBackends("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backends["http"]; !ok || len(backends) != 1 {
+		t.Errorf("expected only http backend kept, got %v", backends)
+	}
+}
+
+// 尚未分配或未应用到service的投递到队列
+func TestRunQueuesMissingAllocations(t *testing.T) {
+	pending := boundService("pending", "", nil, 80)
+	pending.Spec.Type = corev1.ServiceTypeClusterIP
+	unapplied := boundService("unapplied", "", nil, 80)
+	unapplied.Spec.Type = corev1.ServiceTypeClusterIP
+	r := newTestReconciler(t, "", pending, unapplied, boundService("done", "lb-1", nil, 81))
+	queue.New(time.Millisecond, time.Millisecond, 3)
+	defer queue.Q.ShutDown()
+	r.queue = queue.Q
+	for name, port := range map[string]int32{"unapplied": 80, "done": 81} {
+		if err := cache.DB.AddBackend("default", name, "lb-1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.DB.SetBackend("default", name, []cache.Port{{Name: "80", Protocol: "TCP", Port: port}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := r.Run(context.Background())
+	sort.Strings(report.Allocated)
+	if want := []string{"default/pending", "default/unapplied"}; !reflect.DeepEqual(report.Allocated, want) {
+		t.Fatalf("expected allocated %v, got %v", want, report.Allocated)
+	}
+	var types = make(map[string]string)
+	for queue.Q.Len() > 0 {
+		obj, _ := queue.Q.Get()
+		types[obj.Name] = obj.EventType
+		queue.Q.Done(obj, nil)
+	}
+	if want := map[string]string{"pending": model.EventTypeAdded, "unapplied": model.EventTypeModified}; !reflect.DeepEqual(types, want) {
+		t.Errorf("expected events %v, got %v", want, types)
+	}
+}
@@ -0,0 +1,183 @@
+package reconcile
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/model"
+	svc "enforce-shared-lb/internal/processor/service"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"strconv"
+	"time"
+)
+
+// RecoverReport 重建结果
+type RecoverReport struct {
+	StartedAt     time.Time `json:"started_at"`
+	Duration      string    `json:"duration"`
+	Services      int       `json:"services"`
+	LoadBalancers []string  `json:"loadbalancers"`
+	Recovered     []string  `json:"recovered"`
+	Skipped       []string  `json:"skipped"`
+	Errors        []string  `json:"errors"`
+}
+
+// Recover 根据集群中已绑定LB注解的service重建缓存, 用于redis数据丢失后恢复
+// 已存在于缓存中的后端保持不变
+func (r *Reconciler) Recover(ctx context.Context) *RecoverReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var report = &RecoverReport{
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+		logrus.Infof("recover finished in %s, services %d, loadbalancers %d, recovered %d, skipped %d, errors %d",
+			report.Duration, report.Services, len(report.LoadBalancers), len(report.Recovered), len(report.Skipped), len(report.Errors))
+	}()
+
+	services, err := r.listServices(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	for _, service := range services {
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		account, id := r.Accounts.LoadBalancerID(service.Annotations)
+		if id == "" {
+			continue
+		}
+		report.Services++
+		key := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+		// 优先使用service上记录的所属账号, 同一云的多个账号注解键相同, 无法由注解区分
+		if name := service.Annotations[svc.AnnotationAccount]; name != "" {
+			lb, ok := r.Accounts[name]
+			if !ok {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: unknown account %q", key, name))
+				continue
+			}
+			if id = lb.LoadBalancerID(service.Annotations); id == "" {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: no loadbalancer annotation of account %q", key, name))
+				continue
+			}
+			account = name
+		}
+		if exist, _ := cache.DB.GetBackendPorts(service.Namespace, service.Name); exist != "" {
+			report.Skipped = append(report.Skipped, key)
+			continue
+		}
+		created, err := r.recover(account, id, service)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		if created {
+			report.LoadBalancers = append(report.LoadBalancers, id)
+		}
+		report.Recovered = append(report.Recovered, key)
+	}
+	return report
+}
+
+// recover 重建单个service的项目, LB, 端口及后端记录, 返回LB是否为新记录
+// LB记录到service当前的池中, 所属的云账号为service记录的账号, 未记录时为注解匹配的账号
+func (r *Reconciler) recover(account, id string, service *corev1.Service) (bool, error) {
+	var project = service.Namespace
+	policy, _ := svc.ParsePolicy(service)
+	var db = cache.DB.Pool(policy.Pool)
+	err := cache.DB.AddProject(project)
+	if err != nil {
+		return false, err
+	}
+	exist, err := db.ExistLoadBalancer(project, id)
+	if err != nil {
+		return false, err
+	}
+	if !exist {
+		// 设置可用数量
+		err = db.SetLoadBalancerAmount(project, id, 0)
+		if err != nil {
+			return false, err
+		}
+		err = cache.DB.AddBackend(project, id, id)
+		if err != nil {
+			return false, err
+		}
+		err = cache.DB.SetLoadBalancerOwner(project, id, account)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// 独占的LB不再分配给其他service
+	if policy.Dedicated {
+		err = db.SetLoadBalancerDedicated(project, id)
+		if err != nil {
+			return !exist, err
+		}
+	}
+
+	var usingPorts []cache.Port
+	var protocols = make(map[string][]cache.Port)
+	for _, v := range service.Spec.Ports {
+		name := v.Name
+		if name == "" {
+			name = strconv.Itoa(int(v.Port))
+		}
+		port := cache.Port{
+			Name:       name,
+			Protocol:   string(v.Protocol),
+			Port:       v.Port,
+			TargetPort: v.TargetPort.IntVal,
+		}
+		usingPorts = append(usingPorts, port)
+		protocols[port.Protocol] = append(protocols[port.Protocol], port)
+	}
+	for protocol, ports := range protocols {
+		err = db.SetLoadBalancerUsingPorts(project, id, protocol, ports)
+		if err != nil {
+			return !exist, err
+		}
+	}
+	err = cache.DB.AddBackend(project, service.Name, id)
+	if err != nil {
+		return !exist, err
+	}
+	// 由集群中的service重建, 来源为集群监听
+	err = cache.DB.SetBackendSource(project, service.Name, model.Service)
+	if err != nil {
+		return !exist, err
+	}
+	// 亲和组绑定
+	if group := service.Annotations[svc.AnnotationAffinityGroup]; group != "" {
+		err = db.SetAffinity(project, group, service.Name, id)
+		if err != nil {
+			return !exist, err
+		}
+	}
+	// 反亲和键
+	if key := service.Annotations[svc.AnnotationAntiAffinity]; key != "" {
+		err = db.SetAntiAffinity(project, key, service.Name, id)
+		if err != nil {
+			return !exist, err
+		}
+	}
+	// 固定范围内的健康检查端口
+	if hc := r.conf.HealthCheckNodePort; hc != nil && service.Spec.HealthCheckNodePort >= hc.Min && service.Spec.HealthCheckNodePort <= hc.Max {
+		err = cache.DB.SetHealthCheckNodePort(project, service.Name, service.Spec.HealthCheckNodePort)
+		if err != nil {
+			return !exist, err
+		}
+	}
+	if len(usingPorts) == 0 {
+		return !exist, nil
+	}
+	err = cache.DB.SetBackend(project, service.Name, usingPorts)
+	if err != nil {
+		return !exist, err
+	}
+	return !exist, db.SetLoadBalancerAmount(project, id, -int64(len(usingPorts)))
+}
@@ -0,0 +1,107 @@
+package reconcile
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/model"
+	svc "enforce-shared-lb/internal/processor/service"
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// 重建独占的LB后不会再被其他service选中
+func TestRecoverDedicated(t *testing.T) {
+	r := newTestReconciler(t, "",
+		boundService("web", "lb-1", map[string]string{svc.AnnotationDedicated: "true"}, 80),
+		boundService("api", "lb-2", nil, 80),
+	)
+	report := r.Recover(context.Background())
+	if len(report.Recovered) != 2 || len(report.Errors) != 0 {
+		t.Fatalf("expected 2 recovered, got %+v", report)
+	}
+	strategy, _ := cache.GetStrategy(cache.StrategyFirstFit)
+	id, err := cache.DB.GetAvailableLoadBalancer("default", &cache.Request{Num: 1, Exclude: []string{"lb-2"}, Strategy: strategy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" {
+		t.Errorf("expected dedicated lb-1 not available, got %q", id)
+	}
+}
+
+// 由集群中已绑定LB的service重建项目, LB, 端口, 后端, 亲和及健康检查端口, 重复执行时跳过已存在的后端
+func TestRecoverRebuild(t *testing.T) {
+	web := boundService("web", "lb-1", nil, 80, 443)
+	api := boundService("api", "lb-1", nil, 81)
+	login := boundService("login", "lb-2", map[string]string{
+		svc.AnnotationAffinityGroup: "zone-1",
+		svc.AnnotationAntiAffinity:  "game",
+	}, 7000)
+	login.Spec.HealthCheckNodePort = 30100
+	pending := boundService("pending", "", nil, 80)
+	pending.Spec.Type = corev1.ServiceTypeClusterIP
+	r := newTestReconciler(t, `{"health_check_node_port":{"min":30100,"max":30199}}`, web, api, login, pending)
+
+	report := r.Recover(context.Background())
+	sort.Strings(report.LoadBalancers)
+	sort.Strings(report.Recovered)
+	if want := []string{"lb-1", "lb-2"}; !reflect.DeepEqual(report.LoadBalancers, want) {
+		t.Errorf("expected loadbalancers %v, got %v", want, report.LoadBalancers)
+	}
+	if want := []string{"default/api", "default/login", "default/web"}; !reflect.DeepEqual(report.Recovered, want) {
+		t.Fatalf("expected recovered %v, got %v", want, report.Recovered)
+	}
+
+	projects, err := cache.DB.GetProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(projects, []string{"default"}) {
+		t.Errorf("expected project default, got %v", projects)
+	}
+	backends, err := cache.DB.GetBackends("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"web": "lb-1", "api": "lb-1", "login": "lb-2"}; !reflect.DeepEqual(backends, want) {
+		t.Errorf("expected backends %v, got %v", want, backends)
+	}
+	used, err := cache.DB.GetLoadBalancerUsingPorts("default", "lb-1", "TCP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []int
+	for _, v := range used {
+		ports = append(ports, int(v.Port))
+	}
+	sort.Ints(ports)
+	if want := []int{80, 81, 443}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("expected lb-1 ports %v, got %v", want, ports)
+	}
+	usage, err := cache.DB.GetUsage("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.LoadBalancers != 2 || usage.Ports != 4 {
+		t.Errorf("expected usage 2 loadbalancers 4 ports, got %+v", usage)
+	}
+	if bound, _ := cache.DB.GetAffinity("default", "zone-1"); bound != "lb-2" {
+		t.Errorf("expected affinity group bound to lb-2, got %q", bound)
+	}
+	if port, _ := cache.DB.GetHealthCheckNodePort("default", "login", 30100, 30199, nil); port != 30100 {
+		t.Errorf("expected health check node port 30100, got %d", port)
+	}
+	if source, _ := cache.DB.GetBackendSource("default", "web"); source != model.Service {
+		t.Errorf("expected source %s, got %q", model.Service, source)
+	}
+
+	report = r.Recover(context.Background())
+	if len(report.Skipped) != 3 || len(report.Recovered) != 0 {
+		t.Errorf("expected all skipped, got %+v", report)
+	}
+	if usage, _ := cache.DB.GetUsage("default"); usage.Ports != 4 {
+		t.Errorf("expected usage unchanged, got %+v", usage)
+	}
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// groupDemand 亲和组内同一池中尚未分配的成员需要的数量, 包含当前service
+func (s *Service) groupDemand(service *corev1.Service, group, pool string) int64 {
+	var num = int64(len(service.Spec.Ports))
+	if s.client == nil {
+		return num
+	}
+	list, err := s.client.CoreV1().Services(service.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		logrus.Warningf("list services of affinity group %s/%s failed: %v", service.Namespace, group, err)
+		return num
+	}
+	for _, v := range list.Items {
+		if v.Name == service.Name || v.Annotations[AnnotationAffinityGroup] != group {
+			continue
+		}
+		if !s.conf.MatchLabels(v.Labels) {
+			continue
+		}
+		if name, _ := poolName(&v); name != pool {
+			continue
+		}
+		if id, _ := cache.DB.GetBackendPorts(v.Namespace, v.Name); id != "" {
+			continue
+		}
+		num += int64(len(v.Spec.Ports))
+	}
+	return num
+}
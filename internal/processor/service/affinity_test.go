@@ -0,0 +1,63 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+// 亲和组按整个组需要的数量选择LB, 成员跟随组绑定的LB, 绑定的LB容量不足时等待重试
+func TestAffinityGroup(t *testing.T) {
+	s := newTestService(t, `{"cloud":{"name":"fake","max":6}}`)
+	group := func() map[string]string {
+		return map[string]string{AnnotationAffinityGroup: "zone-1"}
+	}
+	web := labeledService("web", nil,
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("https", corev1.ProtocolTCP, 443),
+	)
+	login := labeledService("login", group(),
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("https", corev1.ProtocolTCP, 443),
+	)
+	gateway := labeledService("gateway", group(),
+		servicePort("tcp", corev1.ProtocolTCP, 7000),
+		servicePort("udp", corev1.ProtocolUDP, 7000),
+	)
+	chat := labeledService("chat", group(),
+		servicePort("tcp", corev1.ProtocolTCP, 7100),
+		servicePort("udp", corev1.ProtocolUDP, 7100),
+	)
+	var objects []runtime.Object
+	for _, v := range []*corev1.Service{web, login, gateway} {
+		objects = append(objects, v.DeepCopy())
+	}
+	s.client = k8sfake.NewSimpleClientset(objects...)
+
+	// lb-1 剩余3个, 不足以容纳整个组的4个端口
+	mustProcess(t, s, model.EventTypeAdded, web)
+	mustProcess(t, s, model.EventTypeAdded, login)
+	if id := boundTo(s, login); id != "lb-2" {
+		t.Fatalf("expected login on new lb-2, got %s", id)
+	}
+	mustProcess(t, s, model.EventTypeAdded, gateway)
+	if id := boundTo(s, gateway); id != "lb-2" {
+		t.Fatalf("expected gateway follows group to lb-2, got %s", id)
+	}
+	events(s)
+
+	// 组绑定的LB只剩1个, 新成员不会分配到其他LB
+	if err := process(t, s, model.EventTypeAdded, chat); err == nil {
+		t.Fatalf("expected capacity error, got chat on %s", boundTo(s, chat))
+	}
+	var found bool
+	for _, v := range events(s) {
+		found = found || strings.Contains(v, ReasonCapacityExhausted)
+	}
+	if !found {
+		t.Error("expected CapacityExhausted event")
+	}
+}
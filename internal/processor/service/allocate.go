@@ -0,0 +1,533 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/utils"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// allocateService 为service选择LB并分配全部端口
+// 属于亲和组时使用组绑定的LB, 尚未绑定时按整个组需要的数量选择LB并绑定
+// 有反亲和键时不选择该键数量已满的LB, 没有满足的LB时创建新的LB
+// source为事件来源, 与后端同时记录, 应用到service失败时对账仍能识别并回收
+func (s *Service) allocateService(service *corev1.Service, policy *Policy, source string) error {
+	var num = int64(len(service.Spec.Ports))
+	var originals = make(map[string]int32)
+	for _, v := range service.Spec.Ports {
+		originals[v.Name] = v.Port
+	}
+
+	// 期望的外部端口, strict端口不在允许范围内时任何LB都无法满足
+	var portPolicy = s.conf.PortPolicy(policy.Pool)
+	var desired = s.translatePort(service.Spec.Ports)
+	s.applyPortPolicy(desired, policy)
+	for _, v := range desired {
+		if v.Pin == cache.PinStrict && !portPolicy.Allowed(v.Port) {
+			err := fmt.Errorf("pinned port %s/%s %d is not allowed", v.Name, v.Protocol, v.Port)
+			s.Eventf(service, corev1.EventTypeWarning, ReasonInvalidAnnotation, "%v", err)
+			return utils.Permanent(err)
+		}
+	}
+
+	strategy, _ := cache.GetStrategy(s.conf.ProjectStrategy(service.Namespace))
+	var req = &cache.Request{
+		Num:          num,
+		Ports:        desired,
+		Strategy:     strategy,
+		AntiAffinity: policy.AntiAffinity,
+		MaxPerLB:     policy.AntiAffinityMax,
+	}
+	var db = cache.DB.Pool(policy.Pool)
+	var id string
+	var newPorts []*cache.Port
+	var err error
+	if policy.AntiAffinity != "" {
+		// 同一反亲和键串行, 避免并发时超出数量
+		unlock := s.locker.Lock(service.Namespace + "/anti-affinity/" + policy.AntiAffinity)
+		defer unlock()
+	}
+	var group = policy.AffinityGroup
+	if group != "" {
+		// 同一亲和组串行, 避免并发时绑定到不同的LB
+		unlock := s.locker.Lock(service.Namespace + "/affinity/" + group)
+		defer unlock()
+		id, err = db.GetAffinity(service.Namespace, group)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			req.Num = s.groupDemand(service, group, policy.Pool)
+		}
+	}
+	if id != "" {
+		newPorts, err = s.placeOn(service, policy, id)
+	} else {
+		id, newPorts, err = s.place(service, policy, req)
+	}
+	if err != nil {
+		return err
+	}
+	if group != "" {
+		err = db.SetAffinity(service.Namespace, group, service.Name, id)
+		if err != nil {
+			logrus.Warning(err)
+		}
+	}
+	if policy.AntiAffinity != "" {
+		err = db.SetAntiAffinity(service.Namespace, policy.AntiAffinity, service.Name, id)
+		if err != nil {
+			logrus.Warning(err)
+		}
+	}
+
+	s.Eventf(service, corev1.EventTypeNormal, ReasonLoadBalancerSelected, "selected loadbalancer %s in pool %s for %d ports", id, policy.Pool, num)
+	service.Spec.Ports = s.translateServicePort(service.Spec.Ports, newPorts, policy.EnableTargetPort)
+	if pairs := remapped(originals, service); pairs != "" {
+		s.Eventf(service, corev1.EventTypeNormal, ReasonPortsRemapped, "ports remapped on loadbalancer %s: %s", id, pairs)
+	}
+
+	var usingPorts []cache.Port
+	for _, v := range service.Spec.Ports {
+		usingPorts = append(usingPorts, cache.Port{
+			Name:       v.Name,
+			Port:       v.Port,
+			TargetPort: v.TargetPort.IntVal,
+			Protocol:   string(v.Protocol),
+		})
+	}
+	// 添加到后端集合
+	err = cache.DB.AddBackend(service.Namespace, service.Name, id)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	s.setSource(service, source)
+	// 添加到到已使用集合中
+	err = cache.DB.SetBackend(service.Namespace, service.Name, usingPorts)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	// 应用到service
+	return s.applyService(id, service, policy)
+}
+
+// place 按策略选择LB并分配端口, LB上允许的端口用尽或要求保留的端口不可用时换其他LB
+// 有prefer端口时先在现有LB中查找可保留的位置, 都不满足时再按any处理
+func (s *Service) place(service *corev1.Service, policy *Policy, req *cache.Request) (string, []*cache.Port, error) {
+	var num = int64(len(service.Spec.Ports))
+	var strictPrefer = !policy.Dedicated && policy.hasPin(cache.PinPrefer)
+	for {
+		// 获取可用LB并预占使用量, 查找prefer端口的位置时不创建新的LB
+		id, created, err := s.reserve(service, policy, req, num, !strictPrefer)
+		if err != nil {
+			s.quotaExhausted(service, err, "no loadbalancer in pool %s can hold %d ports", policy.Pool, num)
+			return "", nil, err
+		}
+		if id == "" {
+			strictPrefer = false
+			req.Exclude = nil
+			continue
+		}
+		// 对比ports和service.Spec.Ports
+		backendPorts := s.translatePort(service.Spec.Ports)
+		s.applyPortPolicy(backendPorts, policy)
+		newPorts, err := s.allocate(service.Namespace, id, backendPorts, policy, strictPrefer)
+		if err == nil {
+			return id, newPorts, nil
+		}
+		// 释放预占的使用量
+		_ = cache.DB.Pool(policy.Pool).SetLoadBalancerAmount(service.Namespace, id, num)
+		if !errors.Is(err, cache.ErrPortsExhausted) && !errors.Is(err, cache.ErrPortUnavailable) {
+			return "", nil, err
+		}
+		// 新建的LB也无法满足时不再尝试
+		if created {
+			s.Eventf(service, corev1.EventTypeWarning, ReasonPortsExhausted, "loadbalancer %s: %v", id, err)
+			return "", nil, utils.Permanent(err)
+		}
+		if !strictPrefer {
+			s.Eventf(service, corev1.EventTypeWarning, ReasonPortsExhausted, "loadbalancer %s: %v, try another loadbalancer", id, err)
+		}
+		req.Exclude = append(req.Exclude, id)
+	}
+}
+
+// placeOn 在指定的LB上分配端口, 容量或端口不足时返回错误等待重试
+func (s *Service) placeOn(service *corev1.Service, policy *Policy, id string) ([]*cache.Port, error) {
+	var num = int64(len(service.Spec.Ports))
+	ok, err := s.reserveOn(service, policy, id, num)
+	if err != nil {
+		s.quotaExhausted(service, err, "loadbalancer %s can not hold %d ports", id, num)
+		return nil, err
+	}
+	if !ok {
+		err = fmt.Errorf("loadbalancer %s has no capacity for %d ports", id, num)
+		s.Eventf(service, corev1.EventTypeWarning, ReasonCapacityExhausted, "%v", err)
+		return nil, err
+	}
+	backendPorts := s.translatePort(service.Spec.Ports)
+	s.applyPortPolicy(backendPorts, policy)
+	newPorts, err := s.allocate(service.Namespace, id, backendPorts, policy, false)
+	if err != nil {
+		_ = cache.DB.Pool(policy.Pool).SetLoadBalancerAmount(service.Namespace, id, num)
+		s.Eventf(service, corev1.EventTypeWarning, ReasonPortsExhausted, "loadbalancer %s: %v", id, err)
+		return nil, err
+	}
+	return newPorts, nil
+}
+
+// allocate 在指定LB上按协议为ports分配不冲突且在允许范围内的外部端口并记录到各协议的已使用集合
+// 同一LB串行分配端口, 保证对比结果一致
+// strictPrefer为true时prefer端口也必须保留
+func (s *Service) allocate(project, id string, ports []*cache.Port, policy *Policy, strictPrefer bool) ([]*cache.Port, error) {
+	unlock := s.locker.Lock(project + "/" + id)
+	defer unlock()
+	var db = cache.DB.Pool(policy.Pool)
+	// 获取各协议已经使用的端口
+	var cachePorts = make(map[string][]*cache.Port)
+	for _, v := range ports {
+		if _, ok := cachePorts[v.Protocol]; ok {
+			continue
+		}
+		used, err := db.GetLoadBalancerUsingPorts(project, id, v.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		cachePorts[v.Protocol] = used
+	}
+	newPorts, err := cache.ComparePorts(cachePorts, ports, cache.CompareOptions{
+		Paired:       policy.PairedPorts,
+		Allowed:      s.conf.PortPolicy(policy.Pool).Allowed,
+		StrictPrefer: strictPrefer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var usingPorts = make(map[string][]cache.Port)
+	for _, v := range newPorts {
+		usingPorts[v.Protocol] = append(usingPorts[v.Protocol], *v)
+	}
+	// 添加到到已使用集合中
+	for protocol, v := range usingPorts {
+		err := db.SetLoadBalancerUsingPorts(project, id, protocol, v)
+		if err != nil {
+			logrus.Warning(err)
+		}
+	}
+	return newPorts, nil
+}
+
+// applyPortPolicy 设置期望的外部端口及保留模式
+func (s *Service) applyPortPolicy(ports []*cache.Port, policy *Policy) {
+	for _, v := range ports {
+		if port, ok := policy.ExternalPorts[v.Name]; ok {
+			v.Port = port
+		}
+		v.Pin = policy.Pins[v.Name]
+	}
+}
+
+// sync 已分配的service按端口名与缓存对比, 新增的端口在同一LB上分配, 删除的端口释放
+// 同一LB容量或允许的端口不足时释放全部分配并返回false, 由调用方重新分配到其他LB
+func (s *Service) sync(service *corev1.Service, original *corev1.ServiceSpec, policy *Policy) (bool, error) {
+	var project = service.Namespace
+	id, cachePorts := cache.DB.GetBackendPorts(project, service.Name)
+	if id == "" || cachePorts == nil {
+		return false, nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"namespace": project,
+		"name":      service.Name,
+	})
+
+	// 池变化时重新分配到新的池
+	pool, err := cache.DB.GetLoadBalancerPool(project, id)
+	if err != nil {
+		return false, err
+	}
+	if pool != policy.Pool {
+		log.Infof("pool changed from %s to %s, move from loadbalancer %s", pool, policy.Pool, id)
+		return false, s.unbind(service, original, cachePorts)
+	}
+	var db = cache.DB.Pool(policy.Pool)
+
+	// 独占时LB上还有其他后端则迁移到新的LB, 否则标记为独占, 在项目锁内避免标记前被其他service选中
+	if policy.Dedicated {
+		unlock := s.locker.Lock(project)
+		shared, err := s.shared(project, service.Name, id)
+		if err == nil && !shared {
+			err = db.SetLoadBalancerDedicated(project, id)
+		}
+		unlock()
+		if err != nil {
+			return false, err
+		}
+		if shared {
+			log.Infof("dedicated loadbalancer required, move from shared loadbalancer %s", id)
+			return false, s.unbind(service, original, cachePorts)
+		}
+	}
+
+	var names = make(map[string]bool)
+	for _, v := range service.Spec.Ports {
+		names[v.Name] = true
+	}
+	var cached = make(map[string]bool)
+	var kept []*cache.Port
+	var removed []cache.Port
+	for _, v := range cachePorts {
+		cached[v.Name] = true
+		if names[v.Name] {
+			kept = append(kept, v)
+		} else {
+			removed = append(removed, *v)
+		}
+	}
+	var added []corev1.ServicePort
+	for _, v := range service.Spec.Ports {
+		if !cached[v.Name] {
+			added = append(added, v)
+		}
+	}
+
+	// 亲和组未绑定时绑定到当前LB, 已绑定其他LB时重新分配
+	if group := policy.AffinityGroup; group != "" {
+		unlock := s.locker.Lock(project + "/affinity/" + group)
+		bound, err := db.GetAffinity(project, group)
+		if err == nil && (bound == "" || bound == id) {
+			err = db.SetAffinity(project, group, service.Name, id)
+		}
+		unlock()
+		if err != nil {
+			return false, err
+		}
+		if bound != "" && bound != id {
+			log.Infof("affinity group %s is bound to loadbalancer %s, move from %s", group, bound, id)
+			return false, s.unbind(service, original, cachePorts)
+		}
+	}
+
+	// 记录反亲和键, 已分配的service不会因此迁移
+	if policy.AntiAffinity != "" {
+		err := db.SetAntiAffinity(project, policy.AntiAffinity, service.Name, id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// 已分配的端口不满足strict保留时重新分配
+	for _, v := range kept {
+		if policy.Pins[v.Name] != cache.PinStrict {
+			continue
+		}
+		if port := s.desiredPort(service, policy, v.Name); port != 0 && port != v.Port {
+			log.Infof("port %s is pinned to %d but allocated %d, move to another loadbalancer", v.Name, port, v.Port)
+			return false, s.unbind(service, original, cachePorts)
+		}
+	}
+
+	// 释放已删除的端口
+	if len(removed) > 0 {
+		log.Infof("release removed ports %v", removed)
+		err := cache.DB.RemoveBackendPorts(project, service.Name, id, removed)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(added) > 0 {
+		var num = int64(len(added))
+		ok, err := s.reserveOn(service, policy, id, num)
+		if err != nil {
+			s.quotaExhausted(service, err, "loadbalancer %s can not hold %d new ports", id, num)
+			return false, err
+		}
+		var newPorts []*cache.Port
+		if ok {
+			backendPorts := s.translatePort(added)
+			if policy.PairedPorts {
+				s.pairExistingPorts(service, kept, backendPorts)
+			}
+			s.applyPortPolicy(backendPorts, policy)
+			newPorts, err = s.allocate(project, id, backendPorts, policy, false)
+			if err != nil {
+				_ = db.SetLoadBalancerAmount(project, id, num)
+				if !errors.Is(err, cache.ErrPortsExhausted) && !errors.Is(err, cache.ErrPortUnavailable) {
+					return false, err
+				}
+				s.Eventf(service, corev1.EventTypeWarning, ReasonPortsExhausted, "loadbalancer %s: %v", id, err)
+				ok = false
+			}
+		} else {
+			s.Eventf(service, corev1.EventTypeWarning, ReasonCapacityExhausted,
+				"loadbalancer %s has no capacity for %d new ports", id, num)
+		}
+		if !ok {
+			// 容量或端口不足, 释放全部分配后重新分配到其他LB
+			log.Infof("loadbalancer %s can not hold %d new ports, move to another loadbalancer", id, num)
+			return false, s.unbind(service, original, kept)
+		}
+		var usingPorts []cache.Port
+		for _, v := range newPorts {
+			usingPorts = append(usingPorts, *v)
+		}
+		err = cache.DB.SetBackend(project, service.Name, usingPorts)
+		if err != nil {
+			return false, err
+		}
+		log.Infof("allocate new ports %v", usingPorts)
+		var pairs []string
+		for k, v := range newPorts {
+			if v.Port != added[k].Port {
+				pairs = append(pairs, fmt.Sprintf("%s/%s %d→%d", v.Name, v.Protocol, added[k].Port, v.Port))
+			}
+		}
+		if len(pairs) > 0 {
+			s.Eventf(service, corev1.EventTypeNormal, ReasonPortsRemapped, "ports remapped on loadbalancer %s: %s", id, strings.Join(pairs, ", "))
+		}
+		kept = append(kept, newPorts...)
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+		s.updateOriginalPorts(service, original)
+	}
+	service.Spec.Ports = s.translateServicePort(service.Spec.Ports, kept, policy.EnableTargetPort)
+	return true, s.applyService(id, service, policy)
+}
+
+// shared LB上是否还有其他后端
+func (s *Service) shared(project, name, id string) (bool, error) {
+	backends, err := cache.DB.GetBackends(project)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range backends {
+		if k != name && v == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unbind 释放service的全部分配并还原原始端口, 由调用方重新分配
+// 先按当前声明的端口更新保存的原始spec, 否则重新分配后新增或删除的端口在还原时丢失
+func (s *Service) unbind(service *corev1.Service, original *corev1.ServiceSpec, ports []*cache.Port) error {
+	s.updateOriginalPorts(service, original)
+	var usingPorts []cache.Port
+	for _, v := range ports {
+		usingPorts = append(usingPorts, *v)
+	}
+	err := cache.DB.Clean(service.Namespace, service.Name, usingPorts)
+	if err != nil {
+		return err
+	}
+	s.restoreOriginalPorts(service)
+	s.Accounts.RemoveAnnotation(service.Annotations)
+	delete(service.Annotations, AnnotationAccount)
+	return nil
+}
+
+// desiredPort 端口期望的外部端口, 注解优先于原始端口, 未知时返回0
+func (s *Service) desiredPort(service *corev1.Service, policy *Policy, name string) int32 {
+	if port, ok := policy.ExternalPorts[name]; ok {
+		return port
+	}
+	saved := s.getOriginalSpec(service)
+	if saved == nil {
+		return 0
+	}
+	for _, v := range saved.Ports {
+		if portName(v) == name {
+			return v.Port
+		}
+	}
+	return 0
+}
+
+// pairExistingPorts 新增端口与已分配端口原始端口号相同且协议不同时, 优先使用其外部端口
+func (s *Service) pairExistingPorts(service *corev1.Service, kept, added []*cache.Port) {
+	saved := s.getOriginalSpec(service)
+	if saved == nil {
+		return
+	}
+	var originals = make(map[string]int32)
+	for _, v := range saved.Ports {
+		originals[portName(v)] = v.Port
+	}
+	for _, a := range added {
+		for _, k := range kept {
+			if k.Protocol != a.Protocol && originals[k.Name] == a.Port {
+				a.Port = k.Port
+				break
+			}
+		}
+	}
+}
+
+// reserveOn 在池中指定的LB上预占使用量, 剩余量不足时返回false, 超出项目配额时返回错误
+func (s *Service) reserveOn(service *corev1.Service, policy *Policy, id string, num int64) (bool, error) {
+	var project = service.Namespace
+	var db = cache.DB.Pool(policy.Pool)
+	unlock := s.locker.Lock(project)
+	defer unlock()
+	err := s.checkQuota(service, num, false)
+	if err != nil {
+		return false, err
+	}
+	remain, err := db.GetLoadBalancerAmount(project, id)
+	if err != nil {
+		return false, err
+	}
+	if remain < num {
+		return false, nil
+	}
+	return true, db.SetLoadBalancerAmount(project, id, -num)
+}
+
+// restoreOriginalPorts 重新分配前将已转换的端口还原为原始端口
+func (s *Service) restoreOriginalPorts(service *corev1.Service) {
+	saved := s.getOriginalSpec(service)
+	if saved == nil {
+		return
+	}
+	var ports = make(map[string]int32)
+	for _, v := range saved.Ports {
+		ports[portName(v)] = v.Port
+	}
+	for k, v := range service.Spec.Ports {
+		if port, ok := ports[v.Name]; ok {
+			service.Spec.Ports[k].Port = port
+		}
+	}
+}
+
+// updateOriginalPorts 端口变化后同步更新保存的原始spec, 新增端口使用其声明的端口
+func (s *Service) updateOriginalPorts(service *corev1.Service, original *corev1.ServiceSpec) {
+	saved := s.getOriginalSpec(service)
+	if saved == nil {
+		return
+	}
+	var savedPorts = make(map[string]corev1.ServicePort)
+	for _, v := range saved.Ports {
+		savedPorts[portName(v)] = v
+	}
+	var ports []corev1.ServicePort
+	for _, v := range original.Ports {
+		if p, ok := savedPorts[portName(v)]; ok {
+			ports = append(ports, p)
+			continue
+		}
+		v.NodePort = 0
+		ports = append(ports, v)
+	}
+	saved.Ports = ports
+	data, err := utils.Json.Marshal(saved)
+	if err != nil {
+		logrus.Warning(err)
+		return
+	}
+	service.Annotations[AnnotationOriginalSpec] = string(data)
+}
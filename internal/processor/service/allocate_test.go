@@ -0,0 +1,142 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/model"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+// 新增端口后当前LB容量不足时迁移到新的LB, 保存的原始spec包含新增的端口, 脱离管理时一并还原
+func TestSyncMoveKeepsAddedPort(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil,
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("https", corev1.ProtocolTCP, 443),
+	)
+	mustProcess(t, s, model.EventTypeAdded, web)
+	api := labeledService("api", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, api)
+	if boundTo(s, web) != "lb-1" || boundTo(s, api) != "lb-1" {
+		t.Fatalf("expected both on lb-1, got %s and %s", boundTo(s, web), boundTo(s, api))
+	}
+
+	web.Spec.Ports = append(web.Spec.Ports, servicePort("admin", corev1.ProtocolTCP, 8080))
+	mustProcess(t, s, model.EventTypeModified, web)
+	if id := boundTo(s, web); id != "lb-2" {
+		t.Fatalf("expected web moved to lb-2, got %s", id)
+	}
+	original := s.getOriginalSpec(web)
+	if original == nil || len(original.Ports) != 3 {
+		t.Fatalf("expected 3 original ports, got %+v", original)
+	}
+
+	web.Annotations[AnnotationEnable] = "false"
+	mustProcess(t, s, model.EventTypeModified, web)
+	if web.Spec.Type != corev1.ServiceTypeClusterIP {
+		t.Errorf("expected type %s, got %s", corev1.ServiceTypeClusterIP, web.Spec.Type)
+	}
+	var want = map[string]int32{"http": 80, "https": 443, "admin": 8080}
+	if len(web.Spec.Ports) != len(want) {
+		t.Fatalf("expected ports %v, got %v", want, web.Spec.Ports)
+	}
+	for _, v := range web.Spec.Ports {
+		if want[v.Name] != v.Port {
+			t.Errorf("port %s: expected %d, got %d", v.Name, want[v.Name], v.Port)
+		}
+	}
+}
+
+// 已分配的service设置独占后, LB上还有其他service时迁移到新的LB, 只有自己时原地标记为独占
+func TestSyncDedicated(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	api := labeledService("api", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, web)
+	mustProcess(t, s, model.EventTypeAdded, api)
+
+	web.Annotations[AnnotationDedicated] = "true"
+	mustProcess(t, s, model.EventTypeModified, web)
+	if id := boundTo(s, web); id != "lb-2" {
+		t.Fatalf("expected web moved to lb-2, got %s", id)
+	}
+	if id := boundTo(s, api); id != "lb-1" {
+		t.Fatalf("expected api kept on lb-1, got %s", id)
+	}
+
+	api.Annotations[AnnotationDedicated] = "true"
+	mustProcess(t, s, model.EventTypeModified, api)
+	if id := boundTo(s, api); id != "lb-1" {
+		t.Fatalf("expected api kept on lb-1, got %s", id)
+	}
+	game := labeledService("game", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, game)
+	if id := boundTo(s, game); id != "lb-3" {
+		t.Errorf("expected game on new lb-3, got %s", id)
+	}
+}
+
+// 新增的端口在同一LB上分配, 删除的端口释放并归还使用量
+func TestSyncAddRemovePorts(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, web)
+
+	web.Spec.Ports = append(web.Spec.Ports, servicePort("https", corev1.ProtocolTCP, 443))
+	mustProcess(t, s, model.EventTypeModified, web)
+	id, ports := cache.DB.GetBackendPorts("default", "web")
+	if id != "lb-1" || len(ports) != 2 {
+		t.Fatalf("expected 2 ports on lb-1, got %d on %s", len(ports), id)
+	}
+
+	web.Spec.Ports = web.Spec.Ports[1:]
+	mustProcess(t, s, model.EventTypeModified, web)
+	id, ports = cache.DB.GetBackendPorts("default", "web")
+	if id != "lb-1" || len(ports) != 1 || ports[0].Name != "https" {
+		t.Fatalf("expected https on lb-1, got %v on %s", ports, id)
+	}
+
+	// 释放的使用量可以再分配
+	api := labeledService("api", nil,
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("grpc", corev1.ProtocolTCP, 9090),
+	)
+	mustProcess(t, s, model.EventTypeAdded, api)
+	if id := boundTo(s, api); id != "lb-1" {
+		t.Errorf("expected api on lb-1, got %s", id)
+	}
+}
+
+// 反亲和键相同的service在每个LB上不超过上限, 没有满足的LB时创建新的LB
+func TestAntiAffinitySpread(t *testing.T) {
+	var cases = []struct {
+		name string
+		max  string
+		want []string
+	}{
+		{name: "one per loadbalancer", max: "1", want: []string{"lb-1", "lb-2", "lb-3"}},
+		{name: "two per loadbalancer", max: "2", want: []string{"lb-1", "lb-1", "lb-2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestService(t, "")
+			for k, want := range c.want {
+				zone := labeledService(fmt.Sprintf("zone-%d", k+1), map[string]string{
+					AnnotationAntiAffinity:    "game",
+					AnnotationAntiAffinityMax: c.max,
+				}, servicePort("tcp", corev1.ProtocolTCP, 7000))
+				mustProcess(t, s, model.EventTypeAdded, zone)
+				if id := boundTo(s, zone); id != want {
+					t.Errorf("%s: expected %s, got %s", zone.Name, want, id)
+				}
+			}
+			// 不带反亲和键的service不受限制
+			web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+			mustProcess(t, s, model.EventTypeAdded, web)
+			if id := boundTo(s, web); id != "lb-1" {
+				t.Errorf("expected web on lb-1, got %s", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/utils"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"time"
+)
+
+// AnnotationAllocation 分配结果, 供客户端直接通过kubectl或api读取外部地址及端口映射
+const AnnotationAllocation = "service.kubernetes.io/q1-allocation"
+
+// Allocation 分配结果
+type Allocation struct {
+	LoadBalancerID string           `json:"loadbalancer_id"`
+	Address        string           `json:"address,omitempty"`
+	Ports          []AllocationPort `json:"ports"`
+	AllocatedAt    string           `json:"allocated_at"`
+}
+
+// AllocationPort 原始端口到外部端口的映射
+type AllocationPort struct {
+	Name         string `json:"name"`
+	Protocol     string `json:"protocol"`
+	Port         int32  `json:"port"`
+	ExternalPort int32  `json:"external_port"`
+}
+
+// applyAllocation 在注解中写入分配结果, LB及端口映射未变化时保留原分配时间
+// 地址取自云厂商回写的status, 尚未回写时为空, 回写后的修改事件中补充
+func (s *Service) applyAllocation(id string, service, current *corev1.Service) {
+	var originals = make(map[string]int32)
+	if saved := s.getOriginalSpec(service); saved != nil {
+		for _, v := range saved.Ports {
+			originals[portName(v)] = v.Port
+		}
+	}
+	var allocation = &Allocation{
+		LoadBalancerID: id,
+		AllocatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, v := range service.Spec.Ports {
+		port, ok := originals[v.Name]
+		if !ok {
+			port = v.Port
+		}
+		allocation.Ports = append(allocation.Ports, AllocationPort{
+			Name:         v.Name,
+			Protocol:     string(v.Protocol),
+			Port:         port,
+			ExternalPort: v.Port,
+		})
+	}
+	for _, v := range current.Status.LoadBalancer.Ingress {
+		if v.IP != "" {
+			allocation.Address = v.IP
+			break
+		}
+		if v.Hostname != "" {
+			allocation.Address = v.Hostname
+			break
+		}
+	}
+
+	if old := getAllocation(current); old != nil && old.LoadBalancerID == allocation.LoadBalancerID &&
+		equalAllocationPorts(old.Ports, allocation.Ports) {
+		allocation.AllocatedAt = old.AllocatedAt
+	}
+	data, err := utils.Json.Marshal(allocation)
+	if err != nil {
+		logrus.Warning(err)
+		return
+	}
+	current.Annotations[AnnotationAllocation] = string(data)
+}
+
+// getAllocation 读取注解中的分配结果
+func getAllocation(service *corev1.Service) *Allocation {
+	value, ok := service.Annotations[AnnotationAllocation]
+	if !ok {
+		return nil
+	}
+	var allocation = new(Allocation)
+	if err := utils.Json.Unmarshal([]byte(value), allocation); err != nil {
+		return nil
+	}
+	return allocation
+}
+
+func equalAllocationPorts(a, b []AllocationPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
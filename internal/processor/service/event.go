@@ -0,0 +1,57 @@
+package service
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"strings"
+)
+
+// service 事件原因, 通过 kubectl describe svc 查看
+const (
+	ReasonLoadBalancerSelected = "LoadBalancerSelected"
+	ReasonLoadBalancerCreated  = "LoadBalancerCreated"
+	ReasonCreateFailed         = "CreateLoadBalancerFailed"
+	ReasonPortsRemapped        = "PortsRemapped"
+	ReasonCapacityExhausted    = "CapacityExhausted"
+	ReasonPortsExhausted       = "PortsExhausted"
+	ReasonQuotaExceeded        = "QuotaExceeded"
+	ReasonInvalidAnnotation    = "InvalidAnnotation"
+	ReasonUpdateFailed         = "UpdateFailed"
+	ReasonRetriesExhausted     = "RetriesExhausted"
+)
+
+// newRecorder 事件写入service所在的命名空间
+func newRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(logrus.Debugf)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: client.CoreV1().Events(""),
+	})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: FieldManager})
+}
+
+// Eventf 在service上记录事件, 未连接集群时忽略
+func (s *Service) Eventf(service *corev1.Service, eventType, reason, format string, args ...interface{}) {
+	if s.recorder == nil || service == nil {
+		return
+	}
+	s.recorder.Eventf(service, eventType, reason, format, args...)
+}
+
+// remapped 端口变化列表, 格式为 name/protocol old→new
+func remapped(originals map[string]int32, service *corev1.Service) string {
+	var pairs []string
+	for _, v := range service.Spec.Ports {
+		port, ok := originals[v.Name]
+		if !ok || port == v.Port {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s/%s %d→%d", v.Name, v.Protocol, port, v.Port))
+	}
+	return strings.Join(pairs, ", ")
+}
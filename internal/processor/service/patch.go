@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"enforce-shared-lb/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// FieldManager 写入service时使用的字段管理者
+const FieldManager = "enforce-shared-lb"
+
+// patchService 获取最新的service, 经mutate修改后只将本服务负责的字段以strategic-merge patch写回
+// patch中携带resourceVersion, 期间被修改时返回冲突并基于新的GET重试
+func (s *Service) patchService(namespace, name string, mutate func(service *corev1.Service) error) error {
+	var ctx = context.Background()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := s.client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		modified := current.DeepCopy()
+		err = mutate(modified)
+		if err != nil {
+			return err
+		}
+		patch := ownedPatch(current, modified)
+		if patch == nil {
+			return nil
+		}
+		data, err := utils.Json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		_, err = s.client.CoreV1().Services(namespace).Patch(ctx, name, types.StrategicMergePatchType, data, metav1.PatchOptions{
+			FieldManager: FieldManager,
+		})
+		return err
+	})
+}
+
+// ownedPatch 对比本服务负责的字段: 注解, type, ports, 外部流量策略, 无变化时返回nil
+func ownedPatch(current, modified *corev1.Service) map[string]interface{} {
+	var metadata = make(map[string]interface{})
+	var spec = make(map[string]interface{})
+
+	var annotations = make(map[string]interface{})
+	for k, v := range modified.Annotations {
+		if old, ok := current.Annotations[k]; !ok || old != v {
+			annotations[k] = v
+		}
+	}
+	for k := range current.Annotations {
+		if _, ok := modified.Annotations[k]; !ok {
+			annotations[k] = nil
+		}
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+
+	if current.Spec.Type != modified.Spec.Type {
+		spec["type"] = modified.Spec.Type
+	}
+	if current.Spec.ExternalTrafficPolicy != modified.Spec.ExternalTrafficPolicy {
+		spec["externalTrafficPolicy"] = nullable(modified.Spec.ExternalTrafficPolicy, modified.Spec.ExternalTrafficPolicy == "")
+	}
+	if current.Spec.HealthCheckNodePort != modified.Spec.HealthCheckNodePort {
+		spec["healthCheckNodePort"] = nullable(modified.Spec.HealthCheckNodePort, modified.Spec.HealthCheckNodePort == 0)
+	}
+	if !equality.Semantic.DeepEqual(current.Spec.AllocateLoadBalancerNodePorts, modified.Spec.AllocateLoadBalancerNodePorts) {
+		spec["allocateLoadBalancerNodePorts"] = modified.Spec.AllocateLoadBalancerNodePorts
+	}
+	// ports的合并键只有port, 同端口号的TCP/UDP会被合并, 因此整体替换
+	if !equality.Semantic.DeepEqual(current.Spec.Ports, modified.Spec.Ports) {
+		var ports = []interface{}{
+			map[string]interface{}{"$patch": "replace"},
+		}
+		for _, v := range modified.Spec.Ports {
+			ports = append(ports, v)
+		}
+		spec["ports"] = ports
+	}
+
+	if len(metadata) == 0 && len(spec) == 0 {
+		return nil
+	}
+	metadata["resourceVersion"] = current.ResourceVersion
+	var patch = map[string]interface{}{
+		"metadata": metadata,
+	}
+	if len(spec) > 0 {
+		patch["spec"] = spec
+	}
+	return patch
+}
+
+// keepNodePorts 端口号和协议未变的端口保留已分配的nodePort
+func keepNodePorts(ports, current []corev1.ServicePort) []corev1.ServicePort {
+	var result []corev1.ServicePort
+	for _, v := range ports {
+		v.NodePort = 0
+		for _, c := range current {
+			if c.Port == v.Port && c.Protocol == v.Protocol {
+				v.NodePort = c.NodePort
+				break
+			}
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+func nullable(value interface{}, null bool) interface{} {
+	if null {
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"reflect"
+	"testing"
+)
+
+func managedService() *corev1.Service {
+	service := newService(map[string]string{"owner": "team-a"},
+		servicePort("dns", corev1.ProtocolUDP, 53),
+		servicePort("dns-tcp", corev1.ProtocolTCP, 53),
+	)
+	service.ResourceVersion = "10"
+	service.Labels = map[string]string{"app": "dns"}
+	service.Spec.Selector = map[string]string{"app": "dns"}
+	service.Spec.ClusterIP = "10.0.0.10"
+	return service
+}
+
+func TestOwnedPatch(t *testing.T) {
+	var cases = []struct {
+		name    string
+		current func(service *corev1.Service)
+		modify  func(service *corev1.Service)
+		want    map[string]interface{}
+	}{
+		{
+			name:   "no change",
+			modify: func(service *corev1.Service) {},
+		},
+		{
+			name: "fields not owned are ignored",
+			modify: func(service *corev1.Service) {
+				service.Labels["app"] = "web"
+				service.Spec.Selector = nil
+				service.Spec.ClusterIP = "10.0.0.11"
+			},
+		},
+		{
+			name: "annotations added, changed and removed",
+			modify: func(service *corev1.Service) {
+				service.Annotations = map[string]string{AnnotationAllocation: "{}"}
+			},
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"resourceVersion": "10",
+					"annotations": map[string]interface{}{
+						AnnotationAllocation: "{}",
+						"owner":              nil,
+					},
+				},
+			},
+		},
+		{
+			name: "type and traffic policy",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
+				service.Spec.HealthCheckNodePort = 30100
+			},
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{"resourceVersion": "10"},
+				"spec": map[string]interface{}{
+					"type":                  corev1.ServiceTypeLoadBalancer,
+					"externalTrafficPolicy": corev1.ServiceExternalTrafficPolicyTypeLocal,
+					"healthCheckNodePort":   int32(30100),
+				},
+			},
+		},
+		{
+			name: "cleared fields are deleted",
+			current: func(service *corev1.Service) {
+				service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
+				service.Spec.HealthCheckNodePort = 30100
+			},
+			modify: func(service *corev1.Service) {
+				service.Spec.ExternalTrafficPolicy = ""
+				service.Spec.HealthCheckNodePort = 0
+			},
+			want: map[string]interface{}{
+				"metadata": map[string]interface{}{"resourceVersion": "10"},
+				"spec": map[string]interface{}{
+					"externalTrafficPolicy": nil,
+					"healthCheckNodePort":   nil,
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			current := managedService()
+			if c.current != nil {
+				c.current(current)
+			}
+			modified := current.DeepCopy()
+			c.modify(modified)
+			patch := ownedPatch(current, modified)
+			if c.want == nil {
+				if patch != nil {
+					t.Fatalf("expected no patch, got %v", patch)
+				}
+				return
+			}
+			if !reflect.DeepEqual(patch, c.want) {
+				t.Errorf("expected %v, got %v", c.want, patch)
+			}
+		})
+	}
+}
+
+// 同端口号的TCP/UDP端口应用补丁后保持独立
+func TestOwnedPatchReplacesPorts(t *testing.T) {
+	current := managedService()
+	modified := current.DeepCopy()
+	modified.Spec.Ports[0].Port = 5353
+	modified.Spec.Ports[1].Port = 5353
+	patch := ownedPatch(current, modified)
+	if patch == nil {
+		t.Fatal("expected patch")
+	}
+	original, err := utils.Json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := utils.Json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, data, corev1.Service{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result corev1.Service
+	err = utils.Json.Unmarshal(merged, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(result.Spec.Ports, modified.Spec.Ports) {
+		t.Errorf("expected ports %v, got %v", modified.Spec.Ports, result.Spec.Ports)
+	}
+	if result.Spec.ClusterIP != current.Spec.ClusterIP {
+		t.Errorf("expected cluster ip %s kept, got %s", current.Spec.ClusterIP, result.Spec.ClusterIP)
+	}
+}
+
+func TestKeepNodePorts(t *testing.T) {
+	current := []corev1.ServicePort{
+		{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53, NodePort: 30053},
+		{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+	}
+	ports := []corev1.ServicePort{
+		{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53},
+		{Name: "dns-tcp", Protocol: corev1.ProtocolTCP, Port: 53, NodePort: 31000},
+		{Name: "http", Protocol: corev1.ProtocolTCP, Port: 8080},
+	}
+	var want = []int32{30053, 0, 0}
+	for k, v := range keepNodePorts(ports, current) {
+		if v.NodePort != want[k] {
+			t.Errorf("%s: expected node port %d, got %d", v.Name, want[k], v.NodePort)
+		}
+	}
+}
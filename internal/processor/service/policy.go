@@ -0,0 +1,236 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"strconv"
+	"strings"
+)
+
+// service 注解, 用于单个service覆盖全局行为
+const (
+	// AnnotationEnable 为false时即使标签匹配也不处理
+	AnnotationEnable = "service.kubernetes.io/q1-shared-lb"
+	// AnnotationDedicated 为true时独占一个新的负载均衡器
+	AnnotationDedicated = "service.kubernetes.io/q1-dedicated-lb"
+	// AnnotationExternalTrafficPolicy 外部流量策略, Local 或 Cluster
+	AnnotationExternalTrafficPolicy = "service.kubernetes.io/q1-external-traffic-policy"
+	// AnnotationExternalPorts 期望的外部端口, 格式为 <端口名>=<端口>, 多个以逗号分隔
+	AnnotationExternalPorts = "service.kubernetes.io/q1-external-ports"
+	// AnnotationPortPinning 外部端口保留模式 strict, prefer 或 any, 格式为 <端口名>=<模式>, 多个以逗号分隔, 只有模式时作用于全部端口
+	AnnotationPortPinning = "service.kubernetes.io/q1-port-pinning"
+	// AnnotationAffinityGroup 亲和组, 同一项目中同组的service使用同一个负载均衡器
+	AnnotationAffinityGroup = "service.kubernetes.io/q1-affinity-group"
+	// AnnotationAntiAffinity 反亲和键, 同一项目中该键相同的service分散到不同的负载均衡器
+	AnnotationAntiAffinity = "service.kubernetes.io/q1-anti-affinity"
+	// AnnotationAntiAffinityMax 同一负载均衡器上反亲和键相同的service的最大数量, 默认为1
+	AnnotationAntiAffinityMax = "service.kubernetes.io/q1-anti-affinity-max"
+	// AnnotationPool 负载均衡器池, 优先于池的标签选择器
+	AnnotationPool = "service.kubernetes.io/q1-lb-pool"
+	// AnnotationPairedPorts 为true时端口号相同的TCP/UDP端口分配相同的外部端口
+	AnnotationPairedPorts = "service.kubernetes.io/q1-paired-ports"
+	// AnnotationEnableTargetPort 为true时后端端口使用缓存中的target_port
+	AnnotationEnableTargetPort = "service.kubernetes.io/q1-enable-target_port"
+)
+
+// DefaultPool 默认负载均衡器池
+const DefaultPool = config.DefaultPool
+
+// Policy 由注解解析出的处理策略
+type Policy struct {
+	Disabled              bool
+	Dedicated             bool
+	EnableTargetPort      bool
+	PairedPorts           bool
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType
+	ExternalPorts         map[string]int32
+	Pins                  map[string]string
+	AffinityGroup         string
+	AntiAffinity          string
+	AntiAffinityMax       int
+	Pool                  string
+}
+
+// hasPin 是否有端口使用该保留模式
+func (p *Policy) hasPin(mode string) bool {
+	for _, v := range p.Pins {
+		if v == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePolicy 解析service注解, 所有非法值合并后返回
+func ParsePolicy(service *corev1.Service) (*Policy, error) {
+	var policy = &Policy{
+		Pool:            DefaultPool,
+		AntiAffinityMax: 1,
+	}
+	var annotations = service.Annotations
+	if annotations == nil {
+		policy.Pool = config.Conf.MatchPool(service.Labels)
+		return policy, nil
+	}
+	var errs []error
+	parseBool := func(key string) bool {
+		value, ok := annotations[key]
+		if !ok {
+			return false
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: invalid bool %q", key, value))
+		}
+		return b
+	}
+
+	if value, ok := annotations[AnnotationEnable]; ok {
+		enable, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: invalid bool %q", AnnotationEnable, value))
+		}
+		policy.Disabled = err == nil && !enable
+	}
+	policy.Dedicated = parseBool(AnnotationDedicated)
+	policy.EnableTargetPort = parseBool(AnnotationEnableTargetPort)
+	policy.PairedPorts = parseBool(AnnotationPairedPorts)
+
+	if value, ok := annotations[AnnotationExternalTrafficPolicy]; ok {
+		switch corev1.ServiceExternalTrafficPolicyType(value) {
+		case corev1.ServiceExternalTrafficPolicyTypeLocal, corev1.ServiceExternalTrafficPolicyTypeCluster:
+			policy.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyType(value)
+		default:
+			errs = append(errs, fmt.Errorf("annotation %s: invalid traffic policy %q", AnnotationExternalTrafficPolicy, value))
+		}
+	}
+
+	if value, ok := annotations[AnnotationExternalPorts]; ok {
+		ports, err := parseExternalPorts(service, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %v", AnnotationExternalPorts, err))
+		}
+		policy.ExternalPorts = ports
+	}
+
+	if value, ok := annotations[AnnotationPortPinning]; ok {
+		pins, err := parsePins(service, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %v", AnnotationPortPinning, err))
+		}
+		policy.Pins = pins
+	}
+
+	policy.AffinityGroup = strings.TrimSpace(annotations[AnnotationAffinityGroup])
+	policy.AntiAffinity = strings.TrimSpace(annotations[AnnotationAntiAffinity])
+	if value, ok := annotations[AnnotationAntiAffinityMax]; ok {
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || limit < 1 {
+			errs = append(errs, fmt.Errorf("annotation %s: invalid number %q", AnnotationAntiAffinityMax, value))
+		}
+		policy.AntiAffinityMax = limit
+	}
+
+	pool, err := poolName(service)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	policy.Pool = pool
+	return policy, utilerrors.NewAggregate(errs)
+}
+
+// poolName service使用的负载均衡器池, 注解优先, 未指定时按标签选择
+func poolName(service *corev1.Service) (string, error) {
+	value := strings.TrimSpace(service.Annotations[AnnotationPool])
+	if value == "" {
+		return config.Conf.MatchPool(service.Labels), nil
+	}
+	if !config.Conf.HasPool(value) {
+		return config.Conf.MatchPool(service.Labels), fmt.Errorf("annotation %s: unknown pool %q", AnnotationPool, value)
+	}
+	return value, nil
+}
+
+// parseExternalPorts 解析 <端口名>=<端口>, 端口名需存在于service中
+func parseExternalPorts(service *corev1.Service, value string) (map[string]int32, error) {
+	var names = make(map[string]corev1.Protocol)
+	for _, v := range service.Spec.Ports {
+		names[v.Name] = v.Protocol
+	}
+	var result = make(map[string]int32)
+	var used = make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid item %q", item)
+		}
+		name := strings.TrimSpace(kv[0])
+		protocol, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("port %q not found", name)
+		}
+		port, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 32)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", kv[1])
+		}
+		key := fmt.Sprintf("%s/%d", protocol, port)
+		if used[key] {
+			return nil, fmt.Errorf("duplicate port %s", key)
+		}
+		used[key] = true
+		result[name] = int32(port)
+	}
+	return result, nil
+}
+
+// parsePins 解析 <端口名>=<模式>, 只有模式时作用于全部端口
+func parsePins(service *corev1.Service, value string) (map[string]string, error) {
+	var result = make(map[string]string)
+	checkMode := func(mode string) error {
+		switch mode {
+		case cache.PinStrict, cache.PinPrefer, cache.PinAny:
+			return nil
+		}
+		return fmt.Errorf("invalid mode %q", mode)
+	}
+	value = strings.TrimSpace(value)
+	if value != "" && !strings.Contains(value, "=") {
+		if err := checkMode(value); err != nil {
+			return nil, err
+		}
+		for _, v := range service.Spec.Ports {
+			result[v.Name] = value
+		}
+		return result, nil
+	}
+	var names = make(map[string]bool)
+	for _, v := range service.Spec.Ports {
+		names[v.Name] = true
+	}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid item %q", item)
+		}
+		name, mode := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !names[name] {
+			return nil, fmt.Errorf("port %q not found", name)
+		}
+		if err := checkMode(mode); err != nil {
+			return nil, err
+		}
+		result[name] = mode
+	}
+	return result, nil
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newService(annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web",
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeClusterIP,
+			Ports: ports,
+		},
+	}
+}
+
+func servicePort(name string, protocol corev1.Protocol, port int32) corev1.ServicePort {
+	return corev1.ServicePort{Name: name, Protocol: protocol, Port: port}
+}
+
+func TestParsePolicy(t *testing.T) {
+	pools := config.Conf.Pools
+	config.Conf.Pools = map[string]*config.Pool{"intranet": {}}
+	defer func() {
+		config.Conf.Pools = pools
+	}()
+	var ports = []corev1.ServicePort{
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("dns", corev1.ProtocolUDP, 53),
+		servicePort("dns-tcp", corev1.ProtocolTCP, 53),
+	}
+	var cases = []struct {
+		name        string
+		annotations map[string]string
+		want        *Policy
+		invalid     bool
+	}{
+		{
+			name: "no annotations",
+			want: &Policy{Pool: DefaultPool, AntiAffinityMax: 1},
+		},
+		{
+			name:        "opt out",
+			annotations: map[string]string{AnnotationEnable: "false"},
+			want:        &Policy{Disabled: true, Pool: DefaultPool, AntiAffinityMax: 1},
+		},
+		{
+			name: "flags and traffic policy",
+			annotations: map[string]string{
+				AnnotationEnable:                "true",
+				AnnotationDedicated:             "true",
+				AnnotationPairedPorts:           "true",
+				AnnotationEnableTargetPort:      "1",
+				AnnotationExternalTrafficPolicy: "Cluster",
+			},
+			want: &Policy{
+				Dedicated:             true,
+				PairedPorts:           true,
+				EnableTargetPort:      true,
+				ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeCluster,
+				Pool:                  DefaultPool,
+				AntiAffinityMax:       1,
+			},
+		},
+		{
+			name: "external ports and pins",
+			annotations: map[string]string{
+				AnnotationExternalPorts: "http=8080, dns=5353",
+				AnnotationPortPinning:   "http=strict,dns=prefer",
+			},
+			want: &Policy{
+				ExternalPorts:   map[string]int32{"http": 8080, "dns": 5353},
+				Pins:            map[string]string{"http": cache.PinStrict, "dns": cache.PinPrefer},
+				Pool:            DefaultPool,
+				AntiAffinityMax: 1,
+			},
+		},
+		{
+			name:        "pin mode for all ports",
+			annotations: map[string]string{AnnotationPortPinning: "prefer"},
+			want: &Policy{
+				Pins:            map[string]string{"http": cache.PinPrefer, "dns": cache.PinPrefer, "dns-tcp": cache.PinPrefer},
+				Pool:            DefaultPool,
+				AntiAffinityMax: 1,
+			},
+		},
+		{
+			name: "affinity and pool",
+			annotations: map[string]string{
+				AnnotationAffinityGroup:   " game ",
+				AnnotationAntiAffinity:    "zone",
+				AnnotationAntiAffinityMax: "2",
+				AnnotationPool:            "intranet",
+			},
+			want: &Policy{
+				AffinityGroup:   "game",
+				AntiAffinity:    "zone",
+				AntiAffinityMax: 2,
+				Pool:            "intranet",
+			},
+		},
+		{
+			name: "same port number on different protocols",
+			annotations: map[string]string{
+				AnnotationExternalPorts: "dns=53,dns-tcp=53",
+			},
+			want: &Policy{
+				ExternalPorts:   map[string]int32{"dns": 53, "dns-tcp": 53},
+				Pool:            DefaultPool,
+				AntiAffinityMax: 1,
+			},
+		},
+		{name: "invalid bool", annotations: map[string]string{AnnotationDedicated: "yes"}, invalid: true},
+		{name: "invalid enable", annotations: map[string]string{AnnotationEnable: "off"}, invalid: true},
+		{name: "invalid traffic policy", annotations: map[string]string{AnnotationExternalTrafficPolicy: "local"}, invalid: true},
+		{name: "unknown port name", annotations: map[string]string{AnnotationExternalPorts: "https=443"}, invalid: true},
+		{name: "invalid port", annotations: map[string]string{AnnotationExternalPorts: "http=70000"}, invalid: true},
+		{name: "invalid port item", annotations: map[string]string{AnnotationExternalPorts: "http"}, invalid: true},
+		{name: "duplicate port", annotations: map[string]string{AnnotationExternalPorts: "http=53,dns-tcp=53"}, invalid: true},
+		{name: "invalid pin mode", annotations: map[string]string{AnnotationPortPinning: "always"}, invalid: true},
+		{name: "unknown pinned port", annotations: map[string]string{AnnotationPortPinning: "https=strict"}, invalid: true},
+		{name: "invalid anti-affinity max", annotations: map[string]string{AnnotationAntiAffinityMax: "0"}, invalid: true},
+		{name: "unknown pool", annotations: map[string]string{AnnotationPool: "public"}, invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := ParsePolicy(newService(c.annotations, ports...))
+			if c.invalid {
+				if err == nil {
+					t.Fatalf("expected error, got policy %+v", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policy, c.want) {
+				t.Errorf("expected %+v, got %+v", c.want, policy)
+			}
+		})
+	}
+}
+
+func TestParsePolicyAggregatesErrors(t *testing.T) {
+	_, err := ParsePolicy(newService(map[string]string{
+		AnnotationDedicated:             "yes",
+		AnnotationExternalTrafficPolicy: "local",
+	}))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, key := range []string{AnnotationDedicated, AnnotationExternalTrafficPolicy} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected error for %s, got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/provider"
+	"github.com/sirupsen/logrus"
+)
+
+// Provider 池创建LB使用的客户端, 池未配置客户端时使用默认账号的客户端
+func (s *Service) Provider(pool string) provider.LoadBalancerInterface {
+	if lb, ok := s.Pools[pool]; ok {
+		return lb
+	}
+	return s.Accounts.Get(config.DefaultAccount)
+}
+
+// AnnotationAccount 绑定的LB所属的云账号, 重建缓存时使用
+const AnnotationAccount = "service.kubernetes.io/q1-lb-account"
+
+// owner LB所属的云账号及其客户端, 用于绑定注解等操作, 未记录时为默认账号
+func (s *Service) owner(project, id string) (string, provider.LoadBalancerInterface) {
+	account, err := cache.DB.GetLoadBalancerOwner(project, id)
+	if err != nil {
+		logrus.Warning(err)
+	}
+	if _, ok := s.Accounts[account]; !ok {
+		account = config.DefaultAccount
+	}
+	return account, s.Accounts.Get(account)
+}
+
+// applyPoolAnnotations 设置池附加的注解, 并移除其他池附加且值未被修改的注解
+func (s *Service) applyPoolAnnotations(pool string, annotations map[string]string) {
+	s.removePoolAnnotations(pool, annotations)
+	for k, v := range s.conf.PoolAnnotations(pool) {
+		annotations[k] = v
+	}
+}
+
+// removePoolAnnotations 移除除keep外各池附加且值未被修改的注解, keep为空时移除全部池的注解
+func (s *Service) removePoolAnnotations(keep string, annotations map[string]string) {
+	var kept = s.conf.PoolAnnotations(keep)
+	for _, name := range s.conf.PoolNames() {
+		if name == keep {
+			continue
+		}
+		for k, v := range s.conf.PoolAnnotations(name) {
+			if _, ok := kept[k]; ok {
+				continue
+			}
+			if value, ok := annotations[k]; ok && value == v {
+				delete(annotations, k)
+			}
+		}
+	}
+}
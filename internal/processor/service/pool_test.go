@@ -0,0 +1,54 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/model"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+const intranetAnnotation = "service.beta.kubernetes.io/intranet"
+
+// 各池使用独立的LB, 容量及端口集合, 按注解或标签选择池, 池变化时迁移
+func TestPoolIsolation(t *testing.T) {
+	s := newTestService(t, `{"pools":{"intranet":{"max":3,"selector":{"matchLabels":{"network":"intranet"}},"annotations":{"`+intranetAnnotation+`":"true"}}}}`)
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, web)
+	db := labeledService("db", map[string]string{AnnotationPool: "intranet"}, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, db)
+	if id := boundTo(s, db); id != "intranet-1" {
+		t.Fatalf("expected db on intranet-1, got %s", id)
+	}
+	// 不同池的LB端口互不冲突
+	if port := db.Spec.Ports[0].Port; port != 80 {
+		t.Errorf("expected db keeps port 80, got %d", port)
+	}
+	if db.Annotations[intranetAnnotation] != "true" {
+		t.Errorf("expected pool annotation on db, got %v", db.Annotations)
+	}
+
+	// 按标签选择池, 池中每个LB最多2个端口
+	store := labeledService("store", nil,
+		servicePort("redis", corev1.ProtocolTCP, 6380),
+		servicePort("sentinel", corev1.ProtocolTCP, 26379),
+	)
+	store.Labels["network"] = "intranet"
+	mustProcess(t, s, model.EventTypeAdded, store)
+	if id := boundTo(s, store); id != "intranet-2" {
+		t.Fatalf("expected store on intranet-2, got %s", id)
+	}
+
+	// 池变化时迁移到新池的LB, 移除原池附加的注解
+	web.Annotations[AnnotationPool] = "intranet"
+	mustProcess(t, s, model.EventTypeModified, web)
+	if id := boundTo(s, web); id != "intranet-1" {
+		t.Fatalf("expected web moved to intranet-1, got %s", id)
+	}
+	db.Annotations[AnnotationPool] = DefaultPool
+	mustProcess(t, s, model.EventTypeModified, db)
+	if id := boundTo(s, db); id != "lb-1" {
+		t.Fatalf("expected db moved to lb-1, got %s", id)
+	}
+	if _, ok := db.Annotations[intranetAnnotation]; ok {
+		t.Errorf("expected pool annotation removed, got %v", db.Annotations)
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ErrQuotaExceeded 项目配额已用尽
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// checkQuota 预占前检查项目配额, create为true时检查LB数量, 需在项目锁内调用
+func (s *Service) checkQuota(service *corev1.Service, num int64, create bool) error {
+	quota := s.conf.ProjectQuota(service.Namespace)
+	if quota.LoadBalancers == 0 && quota.Ports == 0 {
+		return nil
+	}
+	usage, err := cache.DB.GetUsage(service.Namespace)
+	if err != nil {
+		return err
+	}
+	if create && quota.LoadBalancers > 0 && usage.LoadBalancers >= quota.LoadBalancers {
+		err = fmt.Errorf("%w: project %s uses %d of %d loadbalancers", ErrQuotaExceeded, service.Namespace, usage.LoadBalancers, quota.LoadBalancers)
+	} else if quota.Ports > 0 && usage.Ports+num > quota.Ports {
+		err = fmt.Errorf("%w: project %s uses %d of %d ports, need %d more", ErrQuotaExceeded, service.Namespace, usage.Ports, quota.Ports, num)
+	}
+	if err != nil {
+		s.Eventf(service, corev1.EventTypeWarning, ReasonQuotaExceeded, "%v", err)
+	}
+	return err
+}
+
+// quotaExhausted 预占因配额失败时在service上记录容量用尽事件
+func (s *Service) quotaExhausted(service *corev1.Service, err error, format string, args ...interface{}) {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return
+	}
+	s.Eventf(service, corev1.EventTypeWarning, ReasonCapacityExhausted, "%s: %v", fmt.Sprintf(format, args...), err)
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/model"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+	"testing"
+)
+
+// 项目达到配额后拒绝分配并记录事件, 项目配置覆盖全局配额
+func TestQuotaExceeded(t *testing.T) {
+	var cases = []struct {
+		name string
+		conf string
+		ok   bool
+	}{
+		{name: "no quota", ok: true},
+		{name: "ports", conf: `{"quota":{"ports":3}}`},
+		{name: "loadbalancers", conf: `{"quota":{"loadbalancers":1}}`},
+		{name: "project override", conf: `{"quota":{"ports":3},"projects":{"default":{"quota":{"ports":4}}}}`, ok: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestService(t, c.conf)
+			web := labeledService("web", nil,
+				servicePort("http", corev1.ProtocolTCP, 80),
+				servicePort("https", corev1.ProtocolTCP, 443),
+				servicePort("admin", corev1.ProtocolTCP, 8080),
+			)
+			mustProcess(t, s, model.EventTypeAdded, web)
+			// lb-1 已满, 需要新的LB及第4个端口
+			api := labeledService("api", nil, servicePort("http", corev1.ProtocolTCP, 80))
+			err := process(t, s, model.EventTypeAdded, api)
+			if c.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("expected %v, got %v", ErrQuotaExceeded, err)
+			}
+			if id, _ := cache.DB.GetBackendPorts("default", "api"); id != "" {
+				t.Errorf("expected api not allocated, got %s", id)
+			}
+			usage, err := cache.DB.GetUsage("default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.LoadBalancers != 1 || usage.Ports != 3 {
+				t.Errorf("expected usage 1 loadbalancer 3 ports, got %+v", usage)
+			}
+			expectEvents(t, s, ReasonQuotaExceeded, ReasonCapacityExhausted)
+		})
+	}
+}
+
+// 已分配的service新增端口超过配额时拒绝并记录事件
+func TestSyncQuotaExceeded(t *testing.T) {
+	s := newTestService(t, `{"quota":{"ports":2}}`)
+	web := labeledService("web", nil,
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("https", corev1.ProtocolTCP, 443),
+	)
+	mustProcess(t, s, model.EventTypeAdded, web)
+	web.Spec.Ports = append(web.Spec.Ports, servicePort("admin", corev1.ProtocolTCP, 8080))
+	if err := process(t, s, model.EventTypeModified, web); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected %v, got %v", ErrQuotaExceeded, err)
+	}
+	if _, ports := cache.DB.GetBackendPorts("default", "web"); len(ports) != 2 {
+		t.Errorf("expected 2 ports kept, got %v", ports)
+	}
+	expectEvents(t, s, ReasonQuotaExceeded, ReasonCapacityExhausted)
+}
+
+// expectEvents 已记录的事件包含全部reasons
+func expectEvents(t *testing.T, s *Service, reasons ...string) {
+	t.Helper()
+	recorded := strings.Join(events(s), "\n")
+	for _, reason := range reasons {
+		if !strings.Contains(recorded, reason) {
+			t.Errorf("expected %s event, got %s", reason, recorded)
+		}
+	}
+}
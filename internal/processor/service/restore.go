@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/utils"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+)
+
+// AnnotationOriginalSpec 转换前的原始spec, 脱离管理时据此还原
+const AnnotationOriginalSpec = "service.kubernetes.io/q1-original-spec"
+
+type originalSpec struct {
+	Type                  corev1.ServiceType                      `json:"type"`
+	Ports                 []corev1.ServicePort                    `json:"ports"`
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType `json:"external_traffic_policy,omitempty"`
+}
+
+// saveOriginalSpec 首次转换时在注解中保存原始spec, 已保存或已转换的不再覆盖
+func (s *Service) saveOriginalSpec(service *corev1.Service, spec *corev1.ServiceSpec) {
+	if _, ok := service.Annotations[AnnotationOriginalSpec]; ok {
+		return
+	}
+	if spec.Type == corev1.ServiceTypeLoadBalancer && s.Accounts.CheckAnnotation(service.Annotations) {
+		return
+	}
+	var original = originalSpec{
+		Type:                  spec.Type,
+		ExternalTrafficPolicy: spec.ExternalTrafficPolicy,
+	}
+	for _, v := range spec.Ports {
+		v.NodePort = 0
+		original.Ports = append(original.Ports, v)
+	}
+	data, err := utils.Json.Marshal(original)
+	if err != nil {
+		logrus.Warning(err)
+		return
+	}
+	if service.Annotations == nil {
+		service.Annotations = make(map[string]string)
+	}
+	service.Annotations[AnnotationOriginalSpec] = string(data)
+}
+
+// getOriginalSpec 读取保存的原始spec
+func (s *Service) getOriginalSpec(service *corev1.Service) *originalSpec {
+	value, ok := service.Annotations[AnnotationOriginalSpec]
+	if !ok {
+		return nil
+	}
+	var original = new(originalSpec)
+	err := utils.Json.Unmarshal([]byte(value), original)
+	if err != nil {
+		logrus.Warningf("service %s/%s has invalid original spec: %v", service.Namespace, service.Name, err)
+		return nil
+	}
+	return original
+}
+
+// release service脱离管理(标签不再匹配或opt out)时还原原始spec, 移除LB注解并释放缓存中的分配
+func (s *Service) release(service *corev1.Service) error {
+	id, ports := cache.DB.GetBackendPorts(service.Namespace, service.Name)
+	original := s.getOriginalSpec(service)
+	// 不是由本服务管理的service
+	if _, bound := s.Accounts.LoadBalancerID(service.Annotations); original == nil && (id == "" || bound != id) {
+		return nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"namespace": service.Namespace,
+		"name":      service.Name,
+	})
+	if original == nil {
+		// 未保存原始spec时还原为ClusterIP并保留当前端口
+		log.Warning("original spec not found, restore to ClusterIP with current ports")
+		original = &originalSpec{
+			Type:  corev1.ServiceTypeClusterIP,
+			Ports: service.Spec.Ports,
+		}
+	}
+
+	s.restoreSpec(service, original)
+	if s.client != nil {
+		err := s.patchService(service.Namespace, service.Name, func(current *corev1.Service) error {
+			s.restoreSpec(current, original)
+			return nil
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			log.Errorf("restore service failed: %v", err)
+			return err
+		}
+	}
+
+	var usingPorts []cache.Port
+	for _, v := range ports {
+		usingPorts = append(usingPorts, *v)
+	}
+	log.Infof("service left management, release loadbalancer %s", id)
+	return cache.DB.Clean(service.Namespace, service.Name, usingPorts)
+}
+
+// ReleaseProject 命名空间移出范围时还原项目下仍存在的service并释放全部分配, 返回已释放的后端名称
+// 还原失败的service保留其分配, 避免LB被自动清理时仍被service使用, 由下次对账重试
+func (s *Service) ReleaseProject(project string) ([]string, error) {
+	backends, err := cache.DB.GetBackends(project)
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	var failed error
+	for name := range backends {
+		if s.client != nil {
+			service, err := s.client.CoreV1().Services(project).Get(context.Background(), name, metav1.GetOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				failed = fmt.Errorf("get service %s/%s: %v", project, name, err)
+				continue
+			}
+			if err == nil {
+				err = s.release(service)
+				if err != nil {
+					failed = fmt.Errorf("release service %s/%s: %v", project, name, err)
+					continue
+				}
+			}
+		}
+		// service不存在或未绑定该LB时直接释放缓存中的分配
+		if id, ports := cache.DB.GetBackendPorts(project, name); id != "" {
+			var usingPorts []cache.Port
+			for _, v := range ports {
+				usingPorts = append(usingPorts, *v)
+			}
+			err = cache.DB.Clean(project, name, usingPorts)
+			if err != nil {
+				failed = err
+				continue
+			}
+		}
+		released = append(released, name)
+	}
+	return released, failed
+}
+
+// restoreSpec 还原spec中由本服务修改的字段
+func (s *Service) restoreSpec(service *corev1.Service, original *originalSpec) {
+	s.Accounts.RemoveAnnotation(service.Annotations)
+	delete(service.Annotations, AnnotationAccount)
+	s.removePoolAnnotations("", service.Annotations)
+	delete(service.Annotations, AnnotationOriginalSpec)
+	delete(service.Annotations, AnnotationAllocation)
+	service.Spec.Type = original.Type
+	var ports []corev1.ServicePort
+	for _, v := range original.Ports {
+		if original.Type == corev1.ServiceTypeClusterIP {
+			v.NodePort = 0
+		}
+		ports = append(ports, v)
+	}
+	service.Spec.Ports = ports
+	service.Spec.ExternalTrafficPolicy = original.ExternalTrafficPolicy
+	service.Spec.HealthCheckNodePort = 0
+	if original.Type != corev1.ServiceTypeLoadBalancer {
+		service.Spec.AllocateLoadBalancerNodePorts = nil
+	}
+}
+
+// portName 端口名为空时以端口号命名, 与处理时的默认名称一致
+func portName(port corev1.ServicePort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	return strconv.Itoa(int(port.Port))
+}
@@ -1,55 +1,80 @@
 package service
 
 import (
-	"context"
 	"enforce-shared-lb/internal/cache"
 	"enforce-shared-lb/internal/config"
 	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
 	"enforce-shared-lb/internal/provider"
-	"github.com/avast/retry-go/v4"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/utils"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
-	"strconv"
-	"time"
+	"k8s.io/client-go/tools/record"
 )
 
 type Service struct {
-	LB     provider.LoadBalancerInterface
-	conf   *config.Configure
-	client *kubernetes.Clientset
+	// Pools 各池创建LB使用的客户端
+	Pools map[string]provider.LoadBalancerInterface
+	// Accounts 各云账号的客户端, 按LB所属的账号绑定注解, 识别service上任一账号的LB注解
+	Accounts loadbalancer.Accounts
+	conf     *config.Configure
+	client   kubernetes.Interface
+	locker   *utils.KeyLock
+	// recorder 在service上记录分配过程的事件
+	recorder record.EventRecorder
 }
 
 func New() *Service {
 	s := &Service{
 		conf:   config.Conf,
-		client: config.KubeClient,
+		locker: utils.NewKeyLock(),
+	}
+	if config.KubeClient != nil {
+		s.client = config.KubeClient
+		s.recorder = newRecorder(s.client)
 	}
 	return s
 }
 
-func (s *Service) RetryProcess(retryObjCh chan model.Event, obj model.Event) {
-	err := retry.Do(
-		func() (err error) {
-			return s.Process(obj)
-		},
-		retry.Attempts(3),
-		retry.DelayType(func(n uint, err error, config *retry.Config) time.Duration {
-			max := time.Duration(n)
-			if max > 8 {
-				max = 8
-			}
-			duration := time.Second * max * max
-			logrus.Errorf("apply service error: %s, %d retry in %s", err, n+1, duration)
-			return duration
-		}),
-		retry.MaxDelay(time.Second*64),
-	)
-	if err != nil {
-		retryObjCh <- obj
+// Validate 校验全局默认的外部流量策略, LB选择策略及健康检查端口范围, 健康检查端口范围需在集群的NodePort范围内
+func (s *Service) Validate() error {
+	for _, pool := range s.conf.PoolNames() {
+		err := s.checkTrafficPolicy(pool, corev1.ServiceExternalTrafficPolicyType(s.conf.ExternalTrafficPolicy))
+		if err != nil {
+			return fmt.Errorf("external_traffic_policy: pool %s: %v", pool, err)
+		}
 	}
+	if _, ok := cache.GetStrategy(s.conf.Strategy); !ok {
+		return fmt.Errorf("strategy: unknown strategy %q", s.conf.Strategy)
+	}
+	for project := range s.conf.Projects {
+		name := s.conf.ProjectStrategy(project)
+		if _, ok := cache.GetStrategy(name); !ok {
+			return fmt.Errorf("projects.%s.strategy: unknown strategy %q", project, name)
+		}
+	}
+	if r := s.conf.HealthCheckNodePort; r != nil {
+		if r.Min <= 0 || r.Max > 65535 || r.Min > r.Max {
+			return fmt.Errorf("health_check_node_port: invalid range %d-%d", r.Min, r.Max)
+		}
+		// 健康检查端口由NodePort分配器校验, 范围外的端口会被api server拒绝
+		n := s.conf.ServiceNodePortRange
+		if n == nil {
+			return fmt.Errorf("service_node_port_range: required by health_check_node_port")
+		}
+		if n.Min <= 0 || n.Max > 65535 || n.Min > n.Max {
+			return fmt.Errorf("service_node_port_range: invalid range %d-%d", n.Min, n.Max)
+		}
+		if r.Min < n.Min || r.Max > n.Max {
+			return fmt.Errorf("health_check_node_port: range %d-%d is outside service_node_port_range %d-%d", r.Min, r.Max, n.Min, n.Max)
+		}
+	}
+	return nil
 }
 
 func (s *Service) Process(obj model.Event) error {
@@ -66,14 +91,28 @@ func (s *Service) Process(obj model.Event) error {
 		"service_type": service.Spec.Type,
 	})
 
-	// skip service without label
-	if s.skipLabel(service.Labels) {
+	// skip service out of namespace scope
+	if !namespace.S.Allowed(service.Namespace) {
 		return nil
 	}
 
+	// service without label, restore it if it was managed before
+	// 删除时标签可能已被修改, 缓存中有分配时仍然释放
+	if !s.conf.MatchLabels(service.Labels) {
+		if obj.EventType == model.EventTypeDeleted {
+			if id, _ := cache.DB.GetBackendPorts(service.Namespace, service.Name); id == "" {
+				return nil
+			}
+			return s.remove(service)
+		}
+		return s.release(service)
+	}
+
+	// 转换前的原始spec
+	original := service.Spec.DeepCopy()
 	for k, v := range service.Spec.Ports {
 		if v.Name == "" {
-			service.Spec.Ports[k].Name = strconv.Itoa(int(v.Port))
+			service.Spec.Ports[k].Name = portName(v)
 		}
 	}
 
@@ -83,137 +122,181 @@ func (s *Service) Process(obj model.Event) error {
 			return nil
 		}
 
-		err := cache.DB.AddProject(service.Namespace)
+		// 解析注解策略, 非法值无需重试
+		policy, err := ParsePolicy(service)
 		if err != nil {
 			log.Warning(err)
+			s.Eventf(service, corev1.EventTypeWarning, ReasonInvalidAnnotation, "%v", err)
+			return utils.Permanent(err)
 		}
-
-		// enable target port
-		enTargetPort := s.getEnableTargetPort(service)
-
-		// check service if exist from cache
-		exist := s.checkExist(service, enTargetPort)
-		if exist {
-			return nil
+		// opt out
+		if policy.Disabled {
+			return s.release(service)
 		}
-
-		// 获取可用LB
-		var num = int64(len(service.Spec.Ports))
-		var protocol = string(service.Spec.Ports[0].Protocol)
-		var id string
-		id, err = cache.DB.GetAvailableLoadBalancer(service.Namespace, num)
+		err = s.checkTrafficPolicy(policy.Pool, s.trafficPolicy(policy))
 		if err != nil {
-			log.Error(err)
-			return err
+			log.Warning(err)
+			s.Eventf(service, corev1.EventTypeWarning, ReasonInvalidAnnotation, "%v", err)
+			return utils.Permanent(err)
 		}
+		s.saveOriginalSpec(service, original)
 
-		// 获取新的LoadBalancer
-		if id == "" {
-			id, err = s.newLoadBalancer(service.Namespace)
-			if err != nil {
-				log.Error(err)
-				return err
-			}
+		err = cache.DB.AddProject(service.Namespace)
+		if err != nil {
+			log.Warning(err)
 		}
 
-		// 获取已经使用的端口
-		var cachePorts []*cache.Port
-		cachePorts, err = cache.DB.GetLoadBalancerUsingPorts(service.Namespace, id, protocol)
+		// check service if exist from cache, 端口变化时增量分配
+		exist, err := s.sync(service, original, policy)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
-
-		// 对比ports和service.Spec.Ports
-		backendPorts := s.translatePort(service.Spec.Ports)
-		newPorts := cache.ComparePorts(cachePorts, backendPorts)
-		service.Spec.Ports = s.translateServicePort(service.Spec.Ports, newPorts, enTargetPort)
-
-		var usingPorts []cache.Port
-		for _, v := range service.Spec.Ports {
-			usingPorts = append(usingPorts, cache.Port{
-				Name:       v.Name,
-				Port:       v.Port,
-				TargetPort: v.TargetPort.IntVal,
-				Protocol:   string(v.Protocol),
-			})
-		}
-		// 添加到到已使用集合中
-		err = cache.DB.SetLoadBalancerUsingPorts(service.Namespace, id, protocol, usingPorts)
-		if err != nil {
-			log.Warning(err)
-		}
-		// 添加到后端集合
-		err = cache.DB.AddBackend(service.Namespace, service.Name, id)
-		if err != nil {
-			log.Warning(err)
+		if exist {
+			s.setSource(service, obj.BindType)
+			return nil
 		}
-		// 添加到到已使用集合中
-		err = cache.DB.SetBackend(service.Namespace, service.Name, usingPorts)
-		if err != nil {
-			log.Warning(err)
+		// 已绑定LB但缓存中没有记录, 避免重新分配导致端口变化
+		if s.Accounts.CheckAnnotation(service.Annotations) {
+			log.Warning("loadbalancer annotation exists but allocation not found in cache, run recover to rebuild")
+			return nil
 		}
-		// 增加使用量
-		err = cache.DB.SetLoadBalancerAmount(service.Namespace, id, -num)
+		err = s.allocateService(service, policy, obj.BindType)
 		if err != nil {
 			log.Error(err)
-			return err
 		}
-		// 应用到service
-		return s.applyService(id, service)
+		return err
 	case model.EventTypeDeleted:
-		var ports []cache.Port
-		for _, v := range service.Spec.Ports {
-			ports = append(ports, cache.Port{
-				Name:       v.Name,
-				Protocol:   string(v.Protocol),
-				Port:       v.Port,
-				TargetPort: v.TargetPort.IntVal,
-			})
+		return s.remove(service)
+	}
+	return nil
+}
+
+// remove service删除后释放其分配
+// 按缓存中实际分配的端口释放, HTTP删除请求中的端口为原始声明的端口, 仅在缓存中没有记录时使用
+func (s *Service) remove(service *corev1.Service) error {
+	var ports []cache.Port
+	if id, using := cache.DB.GetBackendPorts(service.Namespace, service.Name); id != "" {
+		for _, v := range using {
+			ports = append(ports, *v)
 		}
 		return cache.DB.Clean(service.Namespace, service.Name, ports)
 	}
-	return nil
+	for _, v := range service.Spec.Ports {
+		ports = append(ports, cache.Port{
+			Name:       v.Name,
+			Protocol:   string(v.Protocol),
+			Port:       v.Port,
+			TargetPort: v.TargetPort.IntVal,
+		})
+	}
+	return cache.DB.Clean(service.Namespace, service.Name, ports)
 }
 
-func (s *Service) newLoadBalancer(project string) (string, error) {
-	id, err := s.LB.Create()
+// reserve 在service的池中选择可用LB并预占使用量, 同一项目串行避免并发时超额分配
+// 按项目的策略从req.Exclude以外剩余量不小于req.Num的LB中选择, 预占num
+// 独占时总是创建新的LB, 且不会被其他service选中, create为false时没有可用的LB返回空
+// 同一项目同时只创建一个LB, 创建期间不持有项目锁, 不阻塞其他service在已有LB上分配
+func (s *Service) reserve(service *corev1.Service, policy *Policy, req *cache.Request, num int64, create bool) (id string, created bool, err error) {
+	var project = service.Namespace
+	id, err = s.reserveAvailable(service, policy, req, num)
+	if err != nil || id != "" || !create {
+		return id, false, err
+	}
+	// 等待期间其他service可能已创建了满足的LB, 重新选择
+	release := s.locker.Lock(project + "/create")
+	defer release()
+	id, err = s.reserveAvailable(service, policy, req, num)
+	if err != nil || id != "" {
+		return id, false, err
+	}
+	unlock := s.locker.Lock(project)
+	err = s.checkQuota(service, 0, true)
+	unlock()
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	// 设置可用数量
-	err = cache.DB.SetLoadBalancerAmount(project, id, 0)
+	// 获取新的LoadBalancer
+	id, err = s.Provider(policy.Pool).Create()
+	if err != nil {
+		s.Eventf(service, corev1.EventTypeWarning, ReasonCreateFailed, "create loadbalancer failed: %v", err)
+		return "", false, err
+	}
+	s.Eventf(service, corev1.EventTypeNormal, ReasonLoadBalancerCreated, "created loadbalancer %s", id)
+
+	unlock = s.locker.Lock(project)
+	defer unlock()
+	err = s.registerLoadBalancer(project, policy.Pool, id)
+	if err != nil {
+		return "", false, err
+	}
+	if policy.Dedicated {
+		err = cache.DB.Pool(policy.Pool).SetLoadBalancerDedicated(project, id)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	// 创建期间其他service可能用掉了端口配额, 未使用的LB由自动清理回收
+	err = s.checkQuota(service, num, false)
+	if err != nil {
+		return "", false, err
+	}
+	// 增加使用量
+	err = cache.DB.Pool(policy.Pool).SetLoadBalancerAmount(project, id, -num)
 	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// reserveAvailable 在项目锁内检查端口配额, 选择已有的LB并预占使用量, 没有可用的LB或独占时返回空
+func (s *Service) reserveAvailable(service *corev1.Service, policy *Policy, req *cache.Request, num int64) (string, error) {
+	var project = service.Namespace
+	var db = cache.DB.Pool(policy.Pool)
+	unlock := s.locker.Lock(project)
+	defer unlock()
+	err := s.checkQuota(service, num, false)
+	if err != nil || policy.Dedicated {
 		return "", err
 	}
-	// 添加到后端集合
-	err = cache.DB.AddBackend(project, id, id)
+	id, err := db.GetAvailableLoadBalancer(project, req)
+	if err != nil || id == "" {
+		return "", err
+	}
+	// 增加使用量
+	err = db.SetLoadBalancerAmount(project, id, -num)
 	if err != nil {
 		return "", err
 	}
-	logrus.Infoln("create new loadBalancer", id)
 	return id, nil
 }
 
-func (s *Service) checkExist(service *corev1.Service, enTargetPort bool) bool {
-	log := logrus.WithFields(logrus.Fields{
-		"namespace":    service.Namespace,
-		"name":         service.Name,
-		"service_ip":   service.Spec.ClusterIP,
-		"service_type": service.Spec.Type,
-	})
-	// 获取当前使用的端口集合
-	id, ports := cache.DB.GetBackendPorts(service.Namespace, service.Name)
-	if ports != nil {
-		service.Spec.Ports = s.translateServicePort(service.Spec.Ports, ports, enTargetPort)
-		err := s.applyService(id, service)
-		if err != nil {
-			log.Error(err)
-			return false
-		}
-		return true
+// setSource 记录后端的事件来源, 对账时只回收来自集群监听的后端
+func (s *Service) setSource(service *corev1.Service, source string) {
+	err := cache.DB.SetBackendSource(service.Namespace, service.Name, source)
+	if err != nil {
+		logrus.Warning(err)
+	}
+}
+
+// registerLoadBalancer 将新创建的LB记录到池中并记录所属的云账号, 需在项目锁内调用
+func (s *Service) registerLoadBalancer(project, pool, id string) error {
+	err := cache.DB.SetLoadBalancerOwner(project, id, s.conf.PoolAccount(pool))
+	if err != nil {
+		return err
+	}
+	// 设置可用数量
+	err = cache.DB.Pool(pool).SetLoadBalancerAmount(project, id, 0)
+	if err != nil {
+		return err
+	}
+	// 添加到后端集合
+	err = cache.DB.AddBackend(project, id, id)
+	if err != nil {
+		return err
 	}
-	return false
+	logrus.Infof("create new loadBalancer %s in pool %s", id, pool)
+	return nil
 }
 
 func (s *Service) translatePort(servicePort []corev1.ServicePort) (result []*cache.Port) {
@@ -248,19 +331,65 @@ func (s *Service) translateServicePort(servicePort []corev1.ServicePort, ports [
 	return result
 }
 
-func (s *Service) applyService(id string, service *corev1.Service) error {
+func (s *Service) applyService(id string, service *corev1.Service, policy *Policy) error {
 	if service.Annotations == nil {
 		service.Annotations = make(map[string]string)
 	}
-	s.LB.Annotation(id, service.Annotations)
+	account, lb := s.owner(service.Namespace, id)
+	lb.Annotation(id, service.Annotations)
+	service.Annotations[AnnotationAccount] = account
+	s.applyPoolAnnotations(policy.Pool, service.Annotations)
 	service.Spec.Type = corev1.ServiceTypeLoadBalancer
-	service.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
-	_, err := s.client.CoreV1().Services(service.Namespace).Update(context.Background(), service, metav1.UpdateOptions{})
-	if err != nil {
-		logrus.Errorf("update service failed: %v", err)
-		return err
+	service.Spec.ExternalTrafficPolicy = s.trafficPolicy(policy)
+	// 未连接集群时只记录分配结果
+	if s.client == nil {
+		return nil
+	}
+	// 只写入注解(含LB所属账号), type, ports, 外部流量策略及健康检查端口, 同时发布分配结果
+	// 选择的健康检查端口已被集群分配时排除后重新选择, 写入成功后记录
+	var exclude = make(map[int32]bool)
+	for {
+		var selected, healthCheckNodePort int32
+		err := s.patchService(service.Namespace, service.Name, func(current *corev1.Service) error {
+			if current.Annotations == nil {
+				current.Annotations = make(map[string]string)
+			}
+			s.Accounts.RemoveAnnotation(current.Annotations)
+			lb.Annotation(id, current.Annotations)
+			current.Annotations[AnnotationAccount] = account
+			s.applyPoolAnnotations(policy.Pool, current.Annotations)
+			if value, ok := service.Annotations[AnnotationOriginalSpec]; ok {
+				current.Annotations[AnnotationOriginalSpec] = value
+			}
+			current.Spec.Ports = keepNodePorts(service.Spec.Ports, current.Spec.Ports)
+			s.applyAllocation(id, service, current)
+			current.Spec.ExternalTrafficPolicy = service.Spec.ExternalTrafficPolicy
+			// 需在修改type前判断是否已有健康检查端口
+			port, err := s.applyHealthCheckNodePort(service, current, exclude)
+			current.Spec.Type = service.Spec.Type
+			selected, healthCheckNodePort = port, current.Spec.HealthCheckNodePort
+			return err
+		})
+		if err != nil && selected != 0 && isHealthCheckNodePortConflict(err) && len(exclude) < maxHealthCheckNodePortRetries {
+			logrus.Warningf("health check node port %d of service %s/%s is already allocated, select another", selected, service.Namespace, service.Name)
+			exclude[selected] = true
+			if err = cache.DB.ReleaseHealthCheckNodePort(service.Namespace, service.Name); err != nil {
+				logrus.Warning(err)
+			}
+			continue
+		}
+		if err != nil {
+			// service尚未创建或已删除, 分配结果保留在缓存中
+			if errors.IsNotFound(err) {
+				logrus.Warningf("service %s/%s not found, skip update", service.Namespace, service.Name)
+				return nil
+			}
+			logrus.Errorf("patch service failed: %v", err)
+			s.Eventf(service, corev1.EventTypeWarning, ReasonUpdateFailed, "update service failed: %v", err)
+			return err
+		}
+		return s.saveHealthCheckNodePort(service, healthCheckNodePort)
 	}
-	return nil
 }
 
 func (s *Service) skipService(service *corev1.Service) bool {
@@ -269,6 +398,11 @@ func (s *Service) skipService(service *corev1.Service) bool {
 		return false
 	}
 
+	// services converted by us
+	if _, ok := service.Annotations[AnnotationOriginalSpec]; ok {
+		return false
+	}
+
 	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
 		// skip services with has externalIP
 		if len(service.Spec.ExternalIPs) > 0 {
@@ -281,37 +415,8 @@ func (s *Service) skipService(service *corev1.Service) bool {
 		}
 
 		// skip services with has lb annotation and value is not empty
-		return s.LB.CheckAnnotation(service.Annotations)
+		return s.Accounts.CheckAnnotation(service.Annotations)
 	}
 	// skip services of other type
 	return true
 }
-
-func (s *Service) getEnableTargetPort(service *corev1.Service) bool {
-	if service.Annotations == nil {
-		return false
-	}
-	if value, ok := service.Annotations["service.kubernetes.io/q1-enable-target_port"]; ok {
-		if value == "true" {
-			return true
-		}
-	}
-	return false
-}
-
-// check if the service has labels
-func (s *Service) skipLabel(labels map[string]string) bool {
-	if labels == nil {
-		return true
-	}
-	var skip bool
-	for key, value := range s.conf.Labels {
-		v, ok := labels[key]
-		if !ok || v != value {
-			skip = true
-			continue
-		}
-		skip = false
-	}
-	return skip
-}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
+	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/provider/loadbalancer/fake"
+	"enforce-shared-lb/internal/utils"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider 按顺序生成LB ID的云厂商, 避免fake创建时的等待
+type testProvider struct {
+	provider.LoadBalancerInterface
+	prefix string
+	lock   sync.Mutex
+	count  int
+}
+
+func newTestProvider(prefix string) *testProvider {
+	return &testProvider{LoadBalancerInterface: fake.New(), prefix: prefix}
+}
+
+func (p *testProvider) Create() (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.count++
+	return fmt.Sprintf("%s-%d", p.prefix, p.count), nil
+}
+
+// newTestService 使用miniredis及fake云厂商创建Service, 每个LB最多3个端口, data为覆盖的配置
+// 未连接集群, 分配结果只修改传入的service
+func newTestService(t *testing.T, data string) *Service {
+	t.Helper()
+	var conf = &config.Configure{
+		KeyPrefix:             "test",
+		ExternalTrafficPolicy: string(corev1.ServiceExternalTrafficPolicyTypeCluster),
+		Strategy:              "first-fit",
+		Namespaces:            new(config.Namespaces),
+		Cloud:                 &config.Cloud{Name: config.FakeCloud, Max: 4},
+	}
+	if data != "" {
+		if err := utils.Json.Unmarshal([]byte(data), conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf.Load()
+	saved := config.Conf
+	config.Conf = conf
+	t.Cleanup(func() {
+		config.Conf = saved
+	})
+	namespace.New()
+
+	mr := miniredis.RunT(t)
+	cache.New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), conf.KeyPrefix, conf.Cloud.Max)
+	var pools = make(map[string]provider.LoadBalancerInterface)
+	for _, name := range conf.PoolNames()[1:] {
+		cache.DB.AddPool(name, conf.PoolMax(name))
+		pools[name] = newTestProvider(name)
+	}
+	return &Service{
+		Pools:    pools,
+		Accounts: loadbalancer.Accounts{config.DefaultAccount: newTestProvider("lb")},
+		conf:     conf,
+		locker:   utils.NewKeyLock(),
+		recorder: record.NewFakeRecorder(1000),
+	}
+}
+
+// labeledService 匹配默认标签的service
+func labeledService(name string, annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+	service := newService(annotations, ports...)
+	service.Name = name
+	service.Labels = map[string]string{
+		"lb_address_type": "internet",
+		"q1autoops_type":  "game-service",
+	}
+	return service
+}
+
+// process 处理service的事件
+func process(t *testing.T, s *Service, eventType string, service *corev1.Service) error {
+	t.Helper()
+	return s.Process(model.Event{
+		BindType:  model.Service,
+		EventType: eventType,
+		Project:   service.Namespace,
+		Name:      service.Name,
+		Data:      service,
+	})
+}
+
+// mustProcess 处理service的事件, 失败时终止
+func mustProcess(t *testing.T, s *Service, eventType string, service *corev1.Service) {
+	t.Helper()
+	if err := process(t, s, eventType, service); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// boundTo service绑定的LB
+func boundTo(s *Service, service *corev1.Service) string {
+	_, id := s.Accounts.LoadBalancerID(service.Annotations)
+	return id
+}
+
+// events 已记录的全部事件
+func events(s *Service) []string {
+	var result []string
+	recorder := s.recorder.(*record.FakeRecorder)
+	for {
+		select {
+		case v := <-recorder.Events:
+			result = append(result, v)
+		default:
+			return result
+		}
+	}
+}
+
+// 应用到service失败时已分配的后端也记录了来源, 对账可以回收
+func TestSourceRecordedWhenApplyFails(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	client := k8sfake.NewSimpleClientset(web.DeepCopy())
+	client.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("api server unavailable")
+	})
+	s.client = client
+	if err := process(t, s, model.EventTypeAdded, web); err == nil {
+		t.Fatal("expected error")
+	}
+	source, err := cache.DB.GetBackendSource("default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != model.Service {
+		t.Errorf("expected source %s, got %q", model.Service, source)
+	}
+}
+
+// blockingProvider 创建LB时等待gate关闭
+type blockingProvider struct {
+	*testProvider
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (p *blockingProvider) Create() (string, error) {
+	p.started <- struct{}{}
+	<-p.gate
+	return p.testProvider.Create()
+}
+
+// 创建LB期间同一项目的其他service仍可在已有的LB上分配
+func TestReserveDoesNotBlockDuringCreate(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, web)
+
+	lb := &blockingProvider{
+		testProvider: s.Accounts[config.DefaultAccount].(*testProvider),
+		started:      make(chan struct{}, 1),
+		gate:         make(chan struct{}),
+	}
+	s.Accounts[config.DefaultAccount] = lb
+	game := labeledService("game", nil,
+		servicePort("http", corev1.ProtocolTCP, 80),
+		servicePort("https", corev1.ProtocolTCP, 443),
+		servicePort("admin", corev1.ProtocolTCP, 8080),
+	)
+	var done = make(chan error, 1)
+	go func() {
+		done <- process(t, s, model.EventTypeAdded, game)
+	}()
+	select {
+	case <-lb.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loadbalancer not created")
+	}
+
+	var allocated = make(chan error, 1)
+	api := labeledService("api", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	go func() {
+		allocated <- process(t, s, model.EventTypeAdded, api)
+	}()
+	select {
+	case err := <-allocated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("allocation blocked by loadbalancer creation")
+	}
+	if id := boundTo(s, api); id != "lb-1" {
+		t.Errorf("expected api on lb-1, got %s", id)
+	}
+
+	close(lb.gate)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if id := boundTo(s, game); id != "lb-2" {
+		t.Errorf("expected game on lb-2, got %s", id)
+	}
+}
+
+// 删除事件中的标签已不匹配时按缓存中的记录释放
+func TestDeleteWithoutLabels(t *testing.T) {
+	s := newTestService(t, "")
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	mustProcess(t, s, model.EventTypeAdded, web)
+	web.Labels = nil
+	mustProcess(t, s, model.EventTypeDeleted, web)
+	if id, _ := cache.DB.GetBackendPorts("default", "web"); id != "" {
+		t.Errorf("expected web released, still on %s", id)
+	}
+}
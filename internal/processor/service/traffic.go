@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// trafficPolicy service实际使用的外部流量策略, 注解优先于全局默认
+func (s *Service) trafficPolicy(policy *Policy) corev1.ServiceExternalTrafficPolicyType {
+	if policy.ExternalTrafficPolicy != "" {
+		return policy.ExternalTrafficPolicy
+	}
+	if s.conf.ExternalTrafficPolicy != "" {
+		return corev1.ServiceExternalTrafficPolicyType(s.conf.ExternalTrafficPolicy)
+	}
+	return corev1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// checkTrafficPolicy 校验池所用的云厂商是否支持该外部流量策略
+func (s *Service) checkTrafficPolicy(pool string, trafficPolicy corev1.ServiceExternalTrafficPolicyType) error {
+	for _, v := range s.Provider(pool).ExternalTrafficPolicies() {
+		if v == trafficPolicy {
+			return nil
+		}
+	}
+	return fmt.Errorf("traffic policy %q is not supported by %s", trafficPolicy, s.conf.Account(s.conf.PoolAccount(pool)).Name)
+}
+
+// maxHealthCheckNodePortRetries 选择的健康检查端口已被集群分配时重新选择的次数
+const maxHealthCheckNodePortRetries = 5
+
+// applyHealthCheckNodePort 外部流量策略为Local且配置了端口范围时固定分配健康检查端口, 返回新选择的端口
+// 已经是Local的LoadBalancer保留现有端口, 集群不允许修改, 新选择时跳过集群中已被占用的NodePort及exclude
+func (s *Service) applyHealthCheckNodePort(service, current *corev1.Service, exclude map[int32]bool) (int32, error) {
+	if current.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
+		current.Spec.HealthCheckNodePort = 0
+		return 0, nil
+	}
+	var r = s.conf.HealthCheckNodePort
+	if r == nil {
+		return 0, nil
+	}
+	if current.Spec.HealthCheckNodePort != 0 && current.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		return 0, nil
+	}
+	used, err := s.usedNodePorts(service)
+	if err != nil {
+		return 0, err
+	}
+	for port := range exclude {
+		used[port] = true
+	}
+	port, err := cache.DB.GetHealthCheckNodePort(service.Namespace, service.Name, r.Min, r.Max, used)
+	if err != nil {
+		return 0, err
+	}
+	current.Spec.HealthCheckNodePort = port
+	return port, nil
+}
+
+// usedNodePorts 集群中其他service已使用的NodePort及健康检查端口
+func (s *Service) usedNodePorts(service *corev1.Service) (map[int32]bool, error) {
+	list, err := s.client.CoreV1().Services(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var used = make(map[int32]bool)
+	for _, v := range list.Items {
+		if v.Namespace == service.Namespace && v.Name == service.Name {
+			continue
+		}
+		for _, port := range v.Spec.Ports {
+			if port.NodePort != 0 {
+				used[port.NodePort] = true
+			}
+		}
+		if v.Spec.HealthCheckNodePort != 0 {
+			used[v.Spec.HealthCheckNodePort] = true
+		}
+	}
+	return used, nil
+}
+
+// saveHealthCheckNodePort 写入service成功后记录实际使用的健康检查端口, 不在范围内或未使用时释放
+func (s *Service) saveHealthCheckNodePort(service *corev1.Service, port int32) error {
+	if r := s.conf.HealthCheckNodePort; r != nil && port >= r.Min && port <= r.Max {
+		return cache.DB.SetHealthCheckNodePort(service.Namespace, service.Name, port)
+	}
+	return cache.DB.ReleaseHealthCheckNodePort(service.Namespace, service.Name)
+}
+
+// isHealthCheckNodePortConflict 健康检查端口已被集群分配导致写入被拒绝
+func isHealthCheckNodePortConflict(err error) bool {
+	if !errors.IsInvalid(err) {
+		return false
+	}
+	status, ok := err.(errors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return false
+	}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Field == "spec.healthCheckNodePort" {
+			return true
+		}
+	}
+	return false
+}
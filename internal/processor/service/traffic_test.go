@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"enforce-shared-lb/internal/cache"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/provider/loadbalancer"
+	"enforce-shared-lb/internal/provider/loadbalancer/fake"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+)
+
+// clusterOnly 只支持Cluster的云厂商
+type clusterOnly struct {
+	provider.LoadBalancerInterface
+}
+
+func (c *clusterOnly) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return []corev1.ServiceExternalTrafficPolicyType{corev1.ServiceExternalTrafficPolicyTypeCluster}
+}
+
+func TestValidate(t *testing.T) {
+	var cases = []struct {
+		name          string
+		lb            provider.LoadBalancerInterface
+		policy        string
+		healthCheck   *config.PortRange
+		nodePortRange *config.PortRange
+		err           string
+	}{
+		{
+			name:   "supported traffic policy",
+			lb:     fake.New(),
+			policy: "Local",
+		},
+		{
+			name:   "unsupported traffic policy",
+			lb:     &clusterOnly{fake.New()},
+			policy: "Local",
+			err:    "external_traffic_policy",
+		},
+		{
+			name:          "health check ports inside node port range",
+			lb:            fake.New(),
+			policy:        "Local",
+			healthCheck:   &config.PortRange{Min: 32000, Max: 32099},
+			nodePortRange: &config.PortRange{Min: 30000, Max: 32767},
+		},
+		{
+			name:          "health check ports outside node port range",
+			lb:            fake.New(),
+			policy:        "Local",
+			healthCheck:   &config.PortRange{Min: 32700, Max: 32800},
+			nodePortRange: &config.PortRange{Min: 30000, Max: 32767},
+			err:           "outside service_node_port_range",
+		},
+		{
+			name:        "node port range required",
+			lb:          fake.New(),
+			policy:      "Local",
+			healthCheck: &config.PortRange{Min: 32000, Max: 32099},
+			err:         "service_node_port_range",
+		},
+		{
+			name:          "invalid health check range",
+			lb:            fake.New(),
+			policy:        "Local",
+			healthCheck:   &config.PortRange{Min: 32099, Max: 32000},
+			nodePortRange: &config.PortRange{Min: 30000, Max: 32767},
+			err:           "health_check_node_port",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Service{
+				Accounts: loadbalancer.Accounts{config.DefaultAccount: c.lb},
+				conf: &config.Configure{
+					Strategy:              "first-fit",
+					ExternalTrafficPolicy: c.policy,
+					HealthCheckNodePort:   c.healthCheck,
+					ServiceNodePortRange:  c.nodePortRange,
+					Cloud:                 &config.Cloud{Name: config.FakeCloud},
+				},
+			}
+			err := s.Validate()
+			if c.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+// 健康检查端口跳过集群中已使用的NodePort, 被api server拒绝时重新选择, 写入成功后才记录
+func TestHealthCheckNodePortConflict(t *testing.T) {
+	s := newTestService(t, `{"external_traffic_policy":"Local","health_check_node_port":{"min":30000,"max":30005}}`)
+	other := newService(nil, servicePort("http", corev1.ProtocolTCP, 80))
+	other.Name = "other"
+	other.Spec.Type = corev1.ServiceTypeLoadBalancer
+	other.Spec.Ports[0].NodePort = 30000
+	other.Spec.HealthCheckNodePort = 30001
+	web := labeledService("web", nil, servicePort("http", corev1.ProtocolTCP, 80))
+	client := k8sfake.NewSimpleClientset(other, web.DeepCopy())
+	// 30002 已被集群分配但不在service列表中, 如并发创建的service
+	client.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction).GetPatch()
+		if !strings.Contains(string(patch), `"healthCheckNodePort":30002`) {
+			return false, nil, nil
+		}
+		return true, nil, errors.NewInvalid(schema.GroupKind{Kind: "Service"}, "web", field.ErrorList{
+			field.Invalid(field.NewPath("spec", "healthCheckNodePort"), 30002, "provided port is already allocated"),
+		})
+	})
+	s.client = client
+
+	mustProcess(t, s, model.EventTypeAdded, web)
+	current, err := client.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Spec.HealthCheckNodePort != 30003 {
+		t.Fatalf("expected health check node port 30003, got %d", current.Spec.HealthCheckNodePort)
+	}
+	port, err := cache.DB.GetHealthCheckNodePort("default", "web", 30000, 30005, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 30003 {
+		t.Errorf("expected recorded port 30003, got %d", port)
+	}
+}
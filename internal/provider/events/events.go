@@ -1,10 +1,11 @@
 package events
 
 import (
-	"enforce-shared-lb/internal/model"
 	"enforce-shared-lb/internal/provider"
 	"enforce-shared-lb/internal/provider/events/http"
 	"enforce-shared-lb/internal/provider/events/kubernetes/service"
+	"enforce-shared-lb/internal/provider/events/rabbitmq"
+	"enforce-shared-lb/internal/queue"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
@@ -12,6 +13,7 @@ import (
 func register(router *gin.Engine) {
 	service.New()
 	http.New(router)
+	rabbitmq.New()
 }
 
 func Init(router *gin.Engine) {
@@ -31,13 +33,13 @@ func Init(router *gin.Engine) {
 	return
 }
 
-func Start(eventCh chan model.Event) {
+func Start(q *queue.Queue) {
 	for _, e := range provider.EventList {
 		if e == nil {
 			continue
 		}
 		go func(e provider.EventInterface) {
-			err := e.StartWatch(eventCh)
+			err := e.StartWatch(q)
 			if err != nil {
 				logrus.Error(err)
 			}
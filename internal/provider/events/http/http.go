@@ -1,13 +1,21 @@
 package http
 
 import (
+	"bytes"
+	"enforce-shared-lb/internal/cache"
 	"enforce-shared-lb/internal/config"
 	"enforce-shared-lb/internal/model"
 	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/queue"
 	"enforce-shared-lb/internal/utils"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"net/http"
+	"time"
 )
 
 type Http struct {
@@ -37,40 +45,132 @@ var eventTypeMap = map[string]string{
 	http.MethodDelete: model.EventTypeDeleted,
 }
 
-func (h *Http) StartWatch(event chan model.Event) error {
+// timeout 等待处理结果的最长时间
+const timeout = time.Second * 150
+
+// maxBodySize 请求体的最大字节数
+const maxBodySize = 8 << 20
+
+type result struct {
+	Namespace      string        `json:"namespace"`
+	Name           string        `json:"name"`
+	LoadBalancerID string        `json:"loadbalancer_id,omitempty"`
+	Ports          []*cache.Port `json:"ports,omitempty"`
+	Error          string        `json:"error,omitempty"`
+}
+
+func (h *Http) StartWatch(q *queue.Queue) error {
 	logrus.Info("http endpoint /events")
 	h.router.Any("/events", func(c *gin.Context) {
-		c.JSON(http.StatusOK, utils.Response(http.StatusOK, nil, "TODO: http event input"))
-		//value, ok := eventTypeMap[r.Method]
-		//if !ok {
-		//	h.render(w, http.StatusBadRequest, "Bad Request")
-		//	return
-		//}
-		//defer func(Body io.ReadCloser) {
-		//	err := Body.Close()
-		//	if err != nil {
-		//		logrus.Error(err)
-		//	}
-		//}(r.Body)
-		//body, err := ioutil.ReadAll(r.Body)
-		//if err != nil || string(body) == "" {
-		//	h.render(w, http.StatusBadRequest, "Bad Request")
-		//	return
-		//}
-		//var service = &corev1.Service{}
-		//err = json.Unmarshal(body, service)
-		//if err != nil {
-		//	h.render(w, http.StatusBadRequest, "Bad Request")
-		//	return
-		//}
-		//h.render(w, http.StatusOK, nil)
-		//event <- model.Event{
-		//	BindType:  model.Http,
-		//	EventType: value,
-		//	Data:      string(body),
-		//}
+		value, ok := eventTypeMap[c.Request.Method]
+		if !ok {
+			c.JSON(http.StatusMethodNotAllowed, utils.Response(http.StatusMethodNotAllowed, nil, "Method Not Allowed"))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize))
+		if err != nil {
+			var code = http.StatusBadRequest
+			if _, ok := err.(*http.MaxBytesError); ok {
+				code = http.StatusRequestEntityTooLarge
+			}
+			c.JSON(code, utils.Response(code, nil, err.Error()))
+			return
+		}
+		services, err := decode(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, utils.Response(http.StatusBadRequest, nil, err.Error()))
+			return
+		}
+		for _, service := range services {
+			if err = utils.ValidateService(service, value != model.EventTypeDeleted); err != nil {
+				c.JSON(http.StatusBadRequest, utils.Response(http.StatusBadRequest, nil, err.Error()))
+				return
+			}
+		}
+
+		// 逐个投递事件, 并等待处理结果
+		var results = make([]*result, len(services))
+		var dones = make([]chan error, len(services))
+		for k, service := range services {
+			dones[k] = make(chan error, 1)
+			q.Add(model.Event{
+				BindType:  model.Http,
+				EventType: value,
+				Project:   service.Namespace,
+				Name:      service.Name,
+				Data:      service,
+				Done:      dones[k],
+			})
+		}
+		var code = http.StatusOK
+		var ctx = c.Request.Context()
+		var timer = time.NewTimer(timeout)
+		defer timer.Stop()
+		for k, service := range services {
+			res := &result{
+				Namespace: service.Namespace,
+				Name:      service.Name,
+			}
+			results[k] = res
+			select {
+			case err = <-dones[k]:
+			case <-timer.C:
+				err = fmt.Errorf("wait for result timeout")
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil {
+				code = http.StatusInternalServerError
+				res.Error = err.Error()
+				continue
+			}
+			res.LoadBalancerID, res.Ports = cache.DB.GetBackendPorts(service.Namespace, service.Name)
+		}
+		c.JSON(code, utils.Response(code, results, nil))
 	})
 	return nil
 }
 
 func (h *Http) Close() {}
+
+// decode 解析单个Service, Service数组或ServiceList
+func decode(body []byte) ([]*corev1.Service, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+	var services []*corev1.Service
+	if body[0] == '[' {
+		err := utils.Json.Unmarshal(body, &services)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var meta metav1.TypeMeta
+		err := utils.Json.Unmarshal(body, &meta)
+		if err != nil {
+			return nil, err
+		}
+		if meta.Kind == "ServiceList" {
+			var list corev1.ServiceList
+			err = utils.Json.Unmarshal(body, &list)
+			if err != nil {
+				return nil, err
+			}
+			for k := range list.Items {
+				services = append(services, &list.Items[k])
+			}
+		} else {
+			var service = new(corev1.Service)
+			err = utils.Json.Unmarshal(body, service)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, service)
+		}
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no service found")
+	}
+	return services, nil
+}
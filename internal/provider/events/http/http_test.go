@@ -0,0 +1,26 @@
+package http
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 超过大小限制的请求体直接拒绝
+func TestEventsBodyTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h := &Http{router: router}
+	if err := h.StartWatch(nil); err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte(" "), maxBodySize+1)
+	req := httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
@@ -4,15 +4,24 @@ import (
 	"context"
 	"enforce-shared-lb/internal/config"
 	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/namespace"
 	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/queue"
+	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"time"
 )
 
 type Service struct {
 	// client kubernetes api 客户端
 	client *kubernetes.Clientset
+	// informers 每个标签选择器一个informer, 断线后自动从resourceVersion恢复, 410 Gone时重新list
+	informers []cache.SharedIndexInformer
 	// cancelFunc 取消函数
 	cancelFunc context.CancelFunc
 	// context 上下文
@@ -33,33 +42,112 @@ func (s *Service) Name() string {
 func (s *Service) Init() (err error) {
 	s.client = config.KubeClient
 	s.context, s.cancelFunc = context.WithCancel(context.Background())
+	// 只监听指定的命名空间, 未指定时监听全部命名空间
+	var namespaces = namespace.S.Watched()
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	// 标签选择器下推到api server过滤
+	for _, ns := range namespaces {
+		for _, selector := range config.Conf.LabelSelectors() {
+			selector := selector
+			factory := informers.NewSharedInformerFactoryWithOptions(
+				s.client,
+				time.Duration(config.Conf.Resync)*time.Second,
+				informers.WithNamespace(ns),
+				informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.LabelSelector = selector
+				}),
+			)
+			s.informers = append(s.informers, factory.Core().V1().Services().Informer())
+		}
+	}
+	return nil
+}
+
+func (s *Service) StartWatch(q *queue.Queue) error {
+	var synced []cache.InformerSynced
+	for _, informer := range s.informers {
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				s.send(q, model.EventTypeAdded, obj)
+			},
+			// 周期性resync时old与new相同, 同样投递以便重新校准
+			UpdateFunc: func(_, obj interface{}) {
+				s.send(q, model.EventTypeModified, obj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				// 删除事件丢失时会收到最后已知状态
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				s.deleted(q, obj)
+			},
+		})
+		if err != nil {
+			return err
+		}
+		go informer.Run(s.context.Done())
+		synced = append(synced, informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(s.context.Done(), synced...) {
+		return nil
+	}
+	logrus.Infoln("service informer synced")
+	<-s.context.Done()
 	return nil
 }
 
-func (s *Service) StartWatch(event chan model.Event) error {
-	watcher, err := s.client.CoreV1().Services(metav1.NamespaceAll).Watch(s.context, metav1.ListOptions{})
-	if err != nil {
-		return err
+// send 投递事件, informer缓存中的对象只读, 需深拷贝
+func (s *Service) send(q *queue.Queue, eventType string, obj interface{}) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	// 不在范围内的命名空间
+	if !namespace.S.Allowed(service.Namespace) {
+		return
+	}
+	service = service.DeepCopy()
+	q.Add(model.Event{
+		BindType:  model.Service,
+		EventType: eventType,
+		Project:   service.Namespace,
+		Name:      service.Name,
+		Data:      service,
+	})
+}
+
+// deleted 标签不再匹配时informer同样产生删除事件, service仍存在时按修改事件处理
+func (s *Service) deleted(q *queue.Queue, obj interface{}) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	current, err := s.client.CoreV1().Services(service.Namespace).Get(s.context, service.Name, metav1.GetOptions{})
+	if err == nil && current.UID == service.UID {
+		s.send(q, model.EventTypeModified, current)
+		return
+	}
+	// 无法确认是否已删除时不释放, 由对账处理
+	if err != nil && !errors.IsNotFound(err) {
+		logrus.Warningf("get service %s/%s failed: %v, skip delete and leave it to reconcile", service.Namespace, service.Name, err)
+		return
+	}
+	s.send(q, model.EventTypeDeleted, service)
+}
+
+// HasSynced 是否已完成首次同步
+func (s *Service) HasSynced() bool {
+	if len(s.informers) == 0 {
+		return false
 	}
-	// watch for changes to the service
-	for {
-		select {
-		case <-s.context.Done():
-			watcher.Stop()
-			return nil
-		case res := <-watcher.ResultChan():
-			service, ok := res.Object.(*corev1.Service)
-			if !ok {
-				continue
-			}
-			event <- model.Event{
-				BindType:  model.Service,
-				EventType: string(res.Type),
-				Project:   service.Namespace,
-				Data:      service,
-			}
+	for _, informer := range s.informers {
+		if !informer.HasSynced() {
+			return false
 		}
 	}
+	return true
 }
 
 func (s *Service) Close() {
@@ -0,0 +1,223 @@
+package rabbitmq
+
+import (
+	"context"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/provider"
+	"enforce-shared-lb/internal/queue"
+	"enforce-shared-lb/internal/utils"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"time"
+)
+
+type RabbitMQ struct {
+	conf *config.RabbitMQ
+	// cancelFunc 取消函数
+	cancelFunc context.CancelFunc
+	// context 上下文
+	context context.Context
+}
+
+func New() {
+	if config.Conf.RabbitMQ == nil || config.Conf.RabbitMQ.Url == "" {
+		return
+	}
+	provider.RegisterEvent(&RabbitMQ{
+		conf: config.Conf.RabbitMQ,
+	})
+}
+
+func (r *RabbitMQ) Name() string {
+	return "rabbitmq"
+}
+
+func (r *RabbitMQ) Init() error {
+	if r.conf.ExchangeType == "" {
+		r.conf.ExchangeType = amqp.ExchangeTopic
+	}
+	if r.conf.RoutingKey == "" {
+		r.conf.RoutingKey = "#"
+	}
+	if r.conf.Queue == "" {
+		r.conf.Queue = "enforce_shared_lb"
+	}
+	if r.conf.Prefetch <= 0 {
+		r.conf.Prefetch = 16
+	}
+	r.context, r.cancelFunc = context.WithCancel(context.Background())
+	return nil
+}
+
+// message 消息体, data为空时整个消息体视为Service
+type message struct {
+	EventType string          `json:"event_type"`
+	Data      *corev1.Service `json:"data"`
+}
+
+func (r *RabbitMQ) StartWatch(q *queue.Queue) error {
+	var delay = time.Second
+	for {
+		connected, err := r.consume(q)
+		select {
+		case <-r.context.Done():
+			return nil
+		default:
+		}
+		// 连接成功过时重置退避
+		if connected {
+			delay = time.Second
+		}
+		if err != nil {
+			logrus.Errorf("rabbitmq consume error: %v, reconnect in %s", err, delay)
+		}
+		time.Sleep(delay)
+		if delay < time.Second*32 {
+			delay *= 2
+		}
+	}
+}
+
+// consume 建立连接并消费, 连接断开时返回, connected为是否已开始消费
+func (r *RabbitMQ) consume(q *queue.Queue) (connected bool, err error) {
+	conn, err := amqp.Dial(r.conf.Url)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+	var args amqp.Table
+	if r.conf.DeadLetterExchange != "" {
+		args = amqp.Table{"x-dead-letter-exchange": r.conf.DeadLetterExchange}
+	}
+	_, err = ch.QueueDeclare(r.conf.Queue, true, false, false, false, args)
+	if err != nil {
+		return false, err
+	}
+	if r.conf.Exchange != "" {
+		err = ch.ExchangeDeclare(r.conf.Exchange, r.conf.ExchangeType, true, false, false, false, nil)
+		if err != nil {
+			return false, err
+		}
+		err = ch.QueueBind(r.conf.Queue, r.conf.RoutingKey, r.conf.Exchange, false, nil)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = ch.Qos(r.conf.Prefetch, 0, false)
+	if err != nil {
+		return false, err
+	}
+	deliveries, err := ch.Consume(r.conf.Queue, r.Name(), false, false, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("rabbitmq consume queue %s", r.conf.Queue)
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case <-r.context.Done():
+			return true, nil
+		case e := <-closed:
+			if e == nil {
+				return true, fmt.Errorf("connection closed")
+			}
+			return true, e
+		case d, ok := <-deliveries:
+			if !ok {
+				return true, fmt.Errorf("delivery channel closed")
+			}
+			go r.handle(q, d)
+		}
+	}
+}
+
+// handle 投递事件, 处理成功后才确认消息
+func (r *RabbitMQ) handle(q *queue.Queue, d amqp.Delivery) {
+	obj, err := r.decode(d)
+	if err != nil {
+		logrus.Warningf("rabbitmq reject message %s: %v", d.MessageId, err)
+		_ = d.Reject(false)
+		return
+	}
+	done := make(chan error, 1)
+	obj.Done = done
+	q.Add(*obj)
+	select {
+	case err = <-done:
+	case <-r.context.Done():
+		_ = d.Nack(false, true)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("rabbitmq process %s/%s failed: %v", obj.Project, obj.Name, err)
+	}
+	settle(d, err)
+}
+
+// settle 按处理结果确认消息, 无需重试或已超过重试次数的拒绝且不重新入队, 由死信交换机接收
+// 其他错误重新入队
+func settle(d amqp.Delivery, err error) {
+	switch {
+	case err == nil:
+		_ = d.Ack(false)
+	case utils.IsPermanent(err), errors.Is(err, queue.ErrRetriesExhausted):
+		_ = d.Reject(false)
+	default:
+		_ = d.Nack(false, true)
+	}
+}
+
+func (r *RabbitMQ) decode(d amqp.Delivery) (*model.Event, error) {
+	var msg message
+	err := utils.Json.Unmarshal(d.Body, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Data == nil {
+		msg.Data = new(corev1.Service)
+		err = utils.Json.Unmarshal(d.Body, msg.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 未指定事件类型时使用消息的type属性
+	if msg.EventType == "" {
+		msg.EventType = d.Type
+	}
+	switch msg.EventType {
+	case model.EventTypeAdded, model.EventTypeModified, model.EventTypeDeleted:
+	default:
+		return nil, fmt.Errorf("unsupported event type %q", msg.EventType)
+	}
+	err = utils.ValidateService(msg.Data, msg.EventType != model.EventTypeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Event{
+		BindType:  model.RabbitMQ,
+		EventType: msg.EventType,
+		Project:   msg.Data.Namespace,
+		Name:      msg.Data.Name,
+		Data:      msg.Data,
+	}, nil
+}
+
+func (r *RabbitMQ) Close() {
+	if r.cancelFunc != nil {
+		r.cancelFunc()
+	}
+}
@@ -0,0 +1,129 @@
+package rabbitmq
+
+import (
+	"context"
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/queue"
+	"enforce-shared-lb/internal/utils"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acknowledger 记录消息确认结果的进程内AMQP确认器
+type acknowledger struct {
+	lock    sync.Mutex
+	acked   int
+	nacked  int
+	rejects int
+	requeue bool
+	settled chan struct{}
+}
+
+func newAcknowledger() *acknowledger {
+	return &acknowledger{settled: make(chan struct{}, 1)}
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.lock.Lock()
+	a.acked++
+	a.lock.Unlock()
+	a.settled <- struct{}{}
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.lock.Lock()
+	a.nacked++
+	a.requeue = requeue
+	a.lock.Unlock()
+	a.settled <- struct{}{}
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.lock.Lock()
+	a.rejects++
+	a.requeue = requeue
+	a.lock.Unlock()
+	a.settled <- struct{}{}
+	return nil
+}
+
+func (a *acknowledger) wait(t *testing.T) {
+	select {
+	case <-a.settled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not settled")
+	}
+}
+
+const body = `{"event_type": "ADDED", "data": {"metadata": {"namespace": "game", "name": "svc"}, "spec": {"ports": [{"name": "tcp", "protocol": "TCP", "port": 80}]}}}`
+
+func TestSettle(t *testing.T) {
+	var cases = []struct {
+		name    string
+		err     error
+		acked   int
+		nacked  int
+		rejects int
+		requeue bool
+	}{
+		{name: "success", err: nil, acked: 1},
+		{name: "permanent", err: utils.Permanent(errors.New("invalid annotation")), rejects: 1},
+		{name: "exhausted", err: queue.ErrRetriesExhausted, rejects: 1},
+		{name: "transient", err: errors.New("redis timeout"), nacked: 1, requeue: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ack := newAcknowledger()
+			settle(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, c.err)
+			if ack.acked != c.acked || ack.nacked != c.nacked || ack.rejects != c.rejects || ack.requeue != c.requeue {
+				t.Fatalf("got ack %d nack %d reject %d requeue %v", ack.acked, ack.nacked, ack.rejects, ack.requeue)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var cases = []struct {
+		name    string
+		body    string
+		result  error
+		acked   int
+		nacked  int
+		rejects int
+		requeue bool
+	}{
+		{name: "ack on success", body: body, acked: 1},
+		{name: "reject on permanent", body: body, result: utils.Permanent(errors.New("invalid annotation")), rejects: 1},
+		{name: "reject on exhausted", body: body, result: errors.New("redis timeout"), rejects: 1},
+		{name: "reject on undecodable", body: `{`, rejects: 1},
+		{name: "requeue on shutdown", body: body, result: context.Canceled, nacked: 1, requeue: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			queue.New(time.Millisecond, time.Millisecond, 0)
+			defer queue.Q.ShutDown()
+			r := &RabbitMQ{conf: &config.RabbitMQ{}}
+			_ = r.Init()
+			ack := newAcknowledger()
+			go r.handle(queue.Q, amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(c.body)})
+			if c.body == body {
+				obj, _ := queue.Q.Get()
+				if c.result == context.Canceled {
+					// 停止时未处理完的消息重新入队
+					r.Close()
+				} else {
+					queue.Q.Done(obj, c.result)
+				}
+			}
+			ack.wait(t)
+			if ack.acked != c.acked || ack.nacked != c.nacked || ack.rejects != c.rejects || ack.requeue != c.requeue {
+				t.Fatalf("got ack %d nack %d reject %d requeue %v", ack.acked, ack.nacked, ack.rejects, ack.requeue)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package provider
 
-import "enforce-shared-lb/internal/model"
+import (
+	"enforce-shared-lb/internal/queue"
+	corev1 "k8s.io/api/core/v1"
+)
 
 // EventsService interface
 type EventsService interface {
@@ -8,11 +11,16 @@ type EventsService interface {
 	// Init 初始化
 	Init() error
 	// StartWatch 开始监听
-	StartWatch(chan model.Event) error
+	StartWatch(*queue.Queue) error
 	// Close 关闭
 	Close()
 }
 
+// EventSynced 可选接口, 事件来源是否已完成同步, 用于就绪检查
+type EventSynced interface {
+	HasSynced() bool
+}
+
 // EventInterface Events interface
 type EventInterface EventsService
 
@@ -34,8 +42,14 @@ type LoadBalancerService interface {
 	Describe(loadBalancerId string) error
 	// Annotation 绑定注解
 	Annotation(string, map[string]string)
+	// RemoveAnnotation 移除绑定的注解
+	RemoveAnnotation(map[string]string)
 	// CheckAnnotation 检查注解是否已存在
 	CheckAnnotation(map[string]string) bool
+	// LoadBalancerID 从注解中获取已绑定的负载均衡器ID
+	LoadBalancerID(map[string]string) string
+	// ExternalTrafficPolicies 支持的外部流量策略
+	ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType
 }
 
 // LoadBalancerInterface LoadBalancer interface
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"enforce-shared-lb/internal/config"
+	"enforce-shared-lb/internal/provider"
+	"sort"
+)
+
+// Accounts 各云账号的LB客户端, 键为账号名称
+type Accounts map[string]provider.LoadBalancerInterface
+
+// Get 账号的客户端, 账号不存在时使用默认账号
+func (a Accounts) Get(account string) provider.LoadBalancerInterface {
+	if lb, ok := a[account]; ok {
+		return lb
+	}
+	return a[config.DefaultAccount]
+}
+
+// LoadBalancerID 从注解中获取已绑定的LB及其所属账号, 按账号名称顺序取第一个
+func (a Accounts) LoadBalancerID(annotations map[string]string) (account, id string) {
+	for _, name := range a.names() {
+		if id = a[name].LoadBalancerID(annotations); id != "" {
+			return name, id
+		}
+	}
+	return "", ""
+}
+
+// CheckAnnotation 是否已有任一账号的LB注解
+func (a Accounts) CheckAnnotation(annotations map[string]string) bool {
+	_, id := a.LoadBalancerID(annotations)
+	return id != ""
+}
+
+// RemoveAnnotation 移除所有账号的LB注解
+func (a Accounts) RemoveAnnotation(annotations map[string]string) {
+	for _, lb := range a {
+		lb.RemoveAnnotation(annotations)
+	}
+}
+
+// names 默认账号在前, 其余按名称排序
+func (a Accounts) names() []string {
+	var names []string
+	for name := range a {
+		if name != config.DefaultAccount {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := a[config.DefaultAccount]; ok {
+		names = append([]string{config.DefaultAccount}, names...)
+	}
+	return names
+}
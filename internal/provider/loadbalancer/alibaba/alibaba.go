@@ -9,9 +9,12 @@ import (
 	slb "github.com/alibabacloud-go/slb-20140515/v3/client"
 	"github.com/alibabacloud-go/tea/tea"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	"time"
 )
 
+const annotationKey = "service.beta.kubernetes.io/alibaba-cloud-loadbalancer-id"
+
 type aliCloud struct {
 	client          *slb.Client
 	endpoint        *string
@@ -21,13 +24,15 @@ type aliCloud struct {
 	request         *slb.CreateLoadBalancerRequest
 }
 
-func New() provider.LoadBalancerInterface {
+// New 使用cloud中的账号及conf中创建LB的参数
+func New(cloud *config.Cloud, conf interface{}) provider.LoadBalancerInterface {
+	c := conf.(*config.AlibabaConf)
 	a := &aliCloud{
-		endpoint:        config.Conf.Cloud.Endpoint,
-		accessKeyId:     config.Conf.Cloud.AccessKeyId,
-		accessKeySecret: config.Conf.Cloud.AccessKeySecret,
-		conf:            config.Conf.CloudConf.(*config.AlibabaConf),
-		request:         config.Conf.CloudConf.(*slb.CreateLoadBalancerRequest),
+		endpoint:        cloud.Endpoint,
+		accessKeyId:     cloud.AccessKeyId,
+		accessKeySecret: cloud.AccessKeySecret,
+		conf:            c,
+		request:         &c.CreateLoadBalancerRequest,
 	}
 	return a
 }
@@ -67,14 +72,24 @@ func (a *aliCloud) Delete(id string) error { return nil }
 func (a *aliCloud) Describe(id string) error { return nil }
 
 func (a *aliCloud) Annotation(id string, annotation map[string]string) {
-	annotation["service.beta.kubernetes.io/alibaba-cloud-loadbalancer-id"] = id
+	annotation[annotationKey] = id
+}
+
+func (a *aliCloud) RemoveAnnotation(annotation map[string]string) {
+	delete(annotation, annotationKey)
 }
 
 func (a *aliCloud) CheckAnnotation(annotation map[string]string) bool {
-	if _, ok := annotation["service.beta.kubernetes.io/alibaba-cloud-loadbalancer-id"]; ok {
-		if annotation["service.beta.kubernetes.io/alibaba-cloud-loadbalancer-id"] != "" {
-			return true
-		}
+	return a.LoadBalancerID(annotation) != ""
+}
+
+func (a *aliCloud) LoadBalancerID(annotation map[string]string) string {
+	return annotation[annotationKey]
+}
+
+func (a *aliCloud) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return []corev1.ServiceExternalTrafficPolicyType{
+		corev1.ServiceExternalTrafficPolicyTypeLocal,
+		corev1.ServiceExternalTrafficPolicyTypeCluster,
 	}
-	return false
 }
@@ -3,9 +3,12 @@ package fake
 import (
 	"enforce-shared-lb/internal/provider"
 	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
 	"time"
 )
 
+const annotationKey = "service.kubernetes.io/fake-cloud-loadbalancer-id"
+
 type fake struct{}
 
 func New() provider.LoadBalancerInterface {
@@ -26,14 +29,24 @@ func (f *fake) Delete(id string) error { return nil }
 func (f *fake) Describe(id string) error { return nil }
 
 func (f *fake) Annotation(id string, annotation map[string]string) {
-	annotation["service.kubernetes.io/fake-cloud-loadbalancer-id"] = id
+	annotation[annotationKey] = id
+}
+
+func (f *fake) RemoveAnnotation(annotation map[string]string) {
+	delete(annotation, annotationKey)
 }
 
 func (f *fake) CheckAnnotation(annotation map[string]string) bool {
-	if _, ok := annotation["service.kubernetes.io/fake-cloud-loadbalancer-id"]; ok {
-		if annotation["service.kubernetes.io/fake-cloud-loadbalancer-id"] != "" {
-			return true
-		}
+	return f.LoadBalancerID(annotation) != ""
+}
+
+func (f *fake) LoadBalancerID(annotation map[string]string) string {
+	return annotation[annotationKey]
+}
+
+func (f *fake) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return []corev1.ServiceExternalTrafficPolicyType{
+		corev1.ServiceExternalTrafficPolicyTypeLocal,
+		corev1.ServiceExternalTrafficPolicyTypeCluster,
 	}
-	return false
 }
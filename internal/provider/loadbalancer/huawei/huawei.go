@@ -11,9 +11,12 @@ import (
 	"github.com/huaweicloud/huaweicloud-sdk-go-v3/services/elb/v2/model"
 	"github.com/huaweicloud/huaweicloud-sdk-go-v3/services/elb/v2/region"
 	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
 	"time"
 )
 
+const annotationKey = "kubernetes.io/elb.subnet-id"
+
 type huaweiCloud struct {
 	client          *elb.ElbClient
 	endpoint        *string
@@ -25,15 +28,17 @@ type huaweiCloud struct {
 	name            string
 }
 
-func New() provider.LoadBalancerInterface {
+// New 使用cloud中的账号及conf中创建LB的参数
+func New(cloud *config.Cloud, conf interface{}) provider.LoadBalancerInterface {
+	c := conf.(*config.HuaweiConf)
 	h := &huaweiCloud{
-		endpoint:        config.Conf.Cloud.Endpoint,
-		accessKeyId:     config.Conf.Cloud.AccessKeyId,
-		accessKeySecret: config.Conf.Cloud.AccessKeySecret,
-		conf:            config.Conf.CloudConf.(*config.HuaweiConf),
+		endpoint:        cloud.Endpoint,
+		accessKeyId:     cloud.AccessKeyId,
+		accessKeySecret: cloud.AccessKeySecret,
+		conf:            c,
 		request: &model.CreateLoadbalancerRequest{
 			Body: &model.CreateLoadbalancerRequestBody{
-				Loadbalancer: config.Conf.CloudConf.(*model.CreateLoadbalancerReq),
+				Loadbalancer: &c.CreateLoadbalancerReq,
 			},
 		},
 	}
@@ -80,14 +85,24 @@ func (h *huaweiCloud) Delete(id string) error { return nil }
 func (h *huaweiCloud) Describe(id string) error { return nil }
 
 func (h *huaweiCloud) Annotation(id string, annotation map[string]string) {
-	annotation["kubernetes.io/elb.subnet-id"] = id
+	annotation[annotationKey] = id
+}
+
+func (h *huaweiCloud) RemoveAnnotation(annotation map[string]string) {
+	delete(annotation, annotationKey)
 }
 
 func (h *huaweiCloud) CheckAnnotation(annotation map[string]string) bool {
-	if _, ok := annotation["kubernetes.io/elb.subnet-id"]; ok {
-		if annotation["kubernetes.io/elb.subnet-id"] != "" {
-			return true
-		}
+	return h.LoadBalancerID(annotation) != ""
+}
+
+func (h *huaweiCloud) LoadBalancerID(annotation map[string]string) string {
+	return annotation[annotationKey]
+}
+
+func (h *huaweiCloud) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return []corev1.ServiceExternalTrafficPolicyType{
+		corev1.ServiceExternalTrafficPolicyTypeLocal,
+		corev1.ServiceExternalTrafficPolicyTypeCluster,
 	}
-	return false
 }
@@ -7,19 +7,48 @@ import (
 	"enforce-shared-lb/internal/provider/loadbalancer/fake"
 	"enforce-shared-lb/internal/provider/loadbalancer/huawei"
 	"enforce-shared-lb/internal/provider/loadbalancer/tencent"
+	"fmt"
 )
 
-func New() (lb provider.LoadBalancerInterface, err error) {
-	switch config.Conf.Cloud.Name {
+// NewPools 为每个池使用其云账号创建LB客户端, 包含默认池
+func NewPools() (map[string]provider.LoadBalancerInterface, error) {
+	var pools = make(map[string]provider.LoadBalancerInterface)
+	for _, name := range config.Conf.PoolNames() {
+		account := config.Conf.PoolAccount(name)
+		lb, err := newLoadBalancer(config.Conf.Account(account), config.Conf.PoolCloudConf(name))
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", name, err)
+		}
+		pools[name] = lb
+	}
+	return pools, nil
+}
+
+// NewAccounts 为每个云账号创建LB客户端, 包含默认账号
+func NewAccounts() (Accounts, error) {
+	var accounts = make(Accounts)
+	for _, name := range config.Conf.AccountNames() {
+		account := config.Conf.Account(name)
+		lb, err := newLoadBalancer(account, account.CloudConf)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %v", name, err)
+		}
+		accounts[name] = lb
+	}
+	return accounts, nil
+}
+
+func newLoadBalancer(cloud *config.Cloud, conf interface{}) (lb provider.LoadBalancerInterface, err error) {
+	switch cloud.Name {
 	case config.AlibabaCloud:
-		lb = alibaba.New()
+		lb = alibaba.New(cloud, conf)
 	case config.HuaweiCloud:
-		lb = huawei.New()
+		lb = huawei.New(cloud, conf)
 	case config.TencentCloud:
-		lb = tencent.New()
+		lb = tencent.New(cloud, conf)
 	default:
 		lb = fake.New()
 	}
 	err = lb.CreateClient()
-	return lb, err
+	return restrict(lb, cloud.ExternalTrafficPolicies), err
 }
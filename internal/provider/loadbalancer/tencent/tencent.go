@@ -10,9 +10,12 @@ import (
 	clb "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/clb/v20180317"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	corev1 "k8s.io/api/core/v1"
 	"time"
 )
 
+const annotationKey = "service.kubernetes.io/tke-existed-lbid"
+
 type tencentCloud struct {
 	client          *clb.Client
 	endpoint        *string
@@ -22,13 +25,15 @@ type tencentCloud struct {
 	request         *clb.CreateLoadBalancerRequest
 }
 
-func New() provider.LoadBalancerInterface {
+// New 使用cloud中的账号及conf中创建LB的参数
+func New(cloud *config.Cloud, conf interface{}) provider.LoadBalancerInterface {
+	c := conf.(*config.TencentConf)
 	t := &tencentCloud{
-		endpoint:        config.Conf.Cloud.Endpoint,
-		accessKeyId:     config.Conf.Cloud.AccessKeySecret,
-		accessKeySecret: config.Conf.Cloud.AccessKeySecret,
-		conf:            config.Conf.CloudConf.(*config.TencentConf),
-		request:         config.Conf.CloudConf.(*clb.CreateLoadBalancerRequest),
+		endpoint:        cloud.Endpoint,
+		accessKeyId:     cloud.AccessKeyId,
+		accessKeySecret: cloud.AccessKeySecret,
+		conf:            c,
+		request:         &c.CreateLoadBalancerRequest,
 	}
 	return t
 }
@@ -49,7 +54,7 @@ func (t *tencentCloud) Create() (string, error) {
 	request.LoadBalancerName = tea.String(fmt.Sprintf("%s-%d", *t.request.LoadBalancerType, time.Now().Unix()))
 	var resp *clb.CreateLoadBalancerResponse
 	fn := func() (err error) {
-		resp, err = t.client.CreateLoadBalancer(t.request)
+		resp, err = t.client.CreateLoadBalancer(&request)
 		if err != nil {
 			logrus.Error(err)
 			return err
@@ -104,14 +109,24 @@ func (t *tencentCloud) Describe(id string) error {
 }
 
 func (t *tencentCloud) Annotation(id string, annotation map[string]string) {
-	annotation["service.kubernetes.io/tke-existed-lbid"] = id
+	annotation[annotationKey] = id
+}
+
+func (t *tencentCloud) RemoveAnnotation(annotation map[string]string) {
+	delete(annotation, annotationKey)
 }
 
 func (t *tencentCloud) CheckAnnotation(annotation map[string]string) bool {
-	if _, ok := annotation["service.kubernetes.io/tke-existed-lbid"]; ok {
-		if annotation["service.kubernetes.io/tke-existed-lbid"] != "" {
-			return true
-		}
+	return t.LoadBalancerID(annotation) != ""
+}
+
+func (t *tencentCloud) LoadBalancerID(annotation map[string]string) string {
+	return annotation[annotationKey]
+}
+
+func (t *tencentCloud) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return []corev1.ServiceExternalTrafficPolicyType{
+		corev1.ServiceExternalTrafficPolicyTypeLocal,
+		corev1.ServiceExternalTrafficPolicyTypeCluster,
 	}
-	return false
 }
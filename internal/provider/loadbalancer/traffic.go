@@ -0,0 +1,36 @@
+package loadbalancer
+
+import (
+	"enforce-shared-lb/internal/provider"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// restricted 账号配置了external_traffic_policies时, 只报告云厂商与集群中的云控制器都支持的外部流量策略
+type restricted struct {
+	provider.LoadBalancerInterface
+	policies []corev1.ServiceExternalTrafficPolicyType
+}
+
+// restrict 按配置限制客户端支持的外部流量策略, 未配置时不限制
+func restrict(lb provider.LoadBalancerInterface, configured []string) provider.LoadBalancerInterface {
+	if len(configured) == 0 {
+		return lb
+	}
+	var policies []corev1.ServiceExternalTrafficPolicyType
+	for _, v := range lb.ExternalTrafficPolicies() {
+		for _, c := range configured {
+			if string(v) == c {
+				policies = append(policies, v)
+				break
+			}
+		}
+	}
+	return &restricted{
+		LoadBalancerInterface: lb,
+		policies:              policies,
+	}
+}
+
+func (r *restricted) ExternalTrafficPolicies() []corev1.ServiceExternalTrafficPolicyType {
+	return r.policies
+}
@@ -0,0 +1,47 @@
+package loadbalancer
+
+import (
+	"enforce-shared-lb/internal/provider/loadbalancer/fake"
+	corev1 "k8s.io/api/core/v1"
+	"reflect"
+	"testing"
+)
+
+func TestRestrict(t *testing.T) {
+	var cases = []struct {
+		name       string
+		configured []string
+		want       []corev1.ServiceExternalTrafficPolicyType
+	}{
+		{
+			name: "not configured",
+			want: []corev1.ServiceExternalTrafficPolicyType{
+				corev1.ServiceExternalTrafficPolicyTypeLocal,
+				corev1.ServiceExternalTrafficPolicyTypeCluster,
+			},
+		},
+		{
+			name:       "cluster only",
+			configured: []string{"Cluster"},
+			want:       []corev1.ServiceExternalTrafficPolicyType{corev1.ServiceExternalTrafficPolicyTypeCluster},
+		},
+		{
+			name:       "unsupported by provider",
+			configured: []string{"Unknown"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lb := restrict(fake.New(), c.configured)
+			if got := lb.ExternalTrafficPolicies(); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expected %v, got %v", c.want, got)
+			}
+			// 其他方法使用原客户端
+			var annotations = make(map[string]string)
+			lb.Annotation("lb-1", annotations)
+			if id := lb.LoadBalancerID(annotations); id != "lb-1" {
+				t.Errorf("expected lb-1, got %q", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/utils"
+	"errors"
+	"fmt"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"time"
+)
+
+// Queue 以 namespace/name 为键的限速队列
+// 同一个键的重复事件会被合并, 始终只处理最新的对象
+type Queue struct {
+	queue      workqueue.RateLimitingInterface
+	lock       *sync.Mutex
+	items      map[string]*item
+	processing map[string]*item
+	requeues   map[string]int
+	maxRetries int
+	retries    uint64
+	dropped    uint64
+}
+
+type item struct {
+	event model.Event
+	// dones 被合并事件的结果回传通道
+	dones []chan error
+}
+
+type Stats struct {
+	Depth      int            `json:"depth"`
+	Processing int            `json:"processing"`
+	Retries    uint64         `json:"retries"`
+	Dropped    uint64         `json:"dropped"`
+	Requeues   map[string]int `json:"requeues"`
+}
+
+var Q *Queue
+
+// ErrRetriesExhausted 超过最大重试次数后回传的错误
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+func New(baseDelay, maxDelay time.Duration, maxRetries int) {
+	Q = &Queue{
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+			"service",
+		),
+		lock:       new(sync.Mutex),
+		items:      make(map[string]*item),
+		processing: make(map[string]*item),
+		requeues:   make(map[string]int),
+		maxRetries: maxRetries,
+	}
+}
+
+// Key 事件的队列键
+func Key(obj model.Event) string {
+	return fmt.Sprintf("%s/%s", obj.Project, obj.Name)
+}
+
+// Add 添加事件, 已在队列中的同键事件替换为最新对象
+func (q *Queue) Add(obj model.Event) {
+	key := Key(obj)
+	q.lock.Lock()
+	it, ok := q.items[key]
+	if !ok {
+		it = new(item)
+		q.items[key] = it
+	}
+	if obj.Done != nil {
+		it.dones = append(it.dones, obj.Done)
+		obj.Done = nil
+	}
+	it.event = obj
+	q.lock.Unlock()
+	q.queue.Add(key)
+}
+
+// Get 阻塞获取下一个事件, 队列关闭时返回true
+func (q *Queue) Get() (model.Event, bool) {
+	for {
+		k, shutdown := q.queue.Get()
+		if shutdown {
+			return model.Event{}, true
+		}
+		key := k.(string)
+		q.lock.Lock()
+		it, ok := q.items[key]
+		if !ok {
+			q.lock.Unlock()
+			q.queue.Done(key)
+			continue
+		}
+		delete(q.items, key)
+		q.processing[key] = it
+		q.lock.Unlock()
+		return it.event, false
+	}
+}
+
+// Done 标记事件处理完成, 失败时按键指数退避重新入队, 无需重试的错误不再入队
+// 超过最大重试次数后丢弃并返回false
+func (q *Queue) Done(obj model.Event, err error) bool {
+	key := Key(obj)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.queue.Done(key)
+	it, ok := q.processing[key]
+	if !ok {
+		return true
+	}
+	delete(q.processing, key)
+	if err == nil {
+		q.forget(key)
+		it.notify(nil)
+		return true
+	}
+	// 无需重试的错误直接回传
+	if utils.IsPermanent(err) {
+		q.forget(key)
+		it.notify(err)
+		return true
+	}
+	// 处理期间已有更新的对象, 以最新对象为准
+	if newer, ok := q.items[key]; ok {
+		newer.dones = append(newer.dones, it.dones...)
+		q.forget(key)
+		return true
+	}
+	if q.queue.NumRequeues(key) < q.maxRetries {
+		q.items[key] = it
+		q.queue.AddRateLimited(key)
+		q.requeues[key] = q.queue.NumRequeues(key)
+		q.retries++
+		return true
+	}
+	q.forget(key)
+	q.dropped++
+	it.notify(fmt.Errorf("%w: %v", ErrRetriesExhausted, err))
+	return false
+}
+
+func (q *Queue) forget(key string) {
+	q.queue.Forget(key)
+	delete(q.requeues, key)
+}
+
+// Len 队列深度
+func (q *Queue) Len() int {
+	return q.queue.Len()
+}
+
+func (q *Queue) Stats() *Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var requeues = make(map[string]int, len(q.requeues))
+	for k, v := range q.requeues {
+		requeues[k] = v
+	}
+	return &Stats{
+		Depth:      q.queue.Len(),
+		Processing: len(q.processing),
+		Retries:    q.retries,
+		Dropped:    q.dropped,
+		Requeues:   requeues,
+	}
+}
+
+func (q *Queue) ShutDown() {
+	q.queue.ShutDown()
+}
+
+func (it *item) notify(err error) {
+	for _, done := range it.dones {
+		done <- err
+	}
+	it.dones = nil
+}
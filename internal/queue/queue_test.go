@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"enforce-shared-lb/internal/model"
+	"enforce-shared-lb/internal/utils"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newQueue(maxRetries int) *Queue {
+	New(time.Millisecond, time.Millisecond, maxRetries)
+	return Q
+}
+
+func event(eventType string) model.Event {
+	return model.Event{
+		BindType:  model.Service,
+		EventType: eventType,
+		Project:   "default",
+		Name:      "web",
+		Done:      make(chan error, 1),
+	}
+}
+
+// get 获取下一个事件, 超时失败
+func get(t *testing.T, q *Queue) model.Event {
+	t.Helper()
+	var ch = make(chan model.Event, 1)
+	go func() {
+		obj, _ := q.Get()
+		ch <- obj
+	}()
+	select {
+	case obj := <-ch:
+		return obj
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event in queue")
+	}
+	return model.Event{}
+}
+
+// result 读取事件回传的结果, 超时失败
+func result(t *testing.T, done chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("result not notified")
+	}
+	return nil
+}
+
+func TestCollapse(t *testing.T) {
+	q := newQueue(3)
+	defer q.ShutDown()
+	var events = []model.Event{
+		event(model.EventTypeAdded),
+		event(model.EventTypeModified),
+		event(model.EventTypeDeleted),
+	}
+	for _, v := range events {
+		q.Add(v)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 key in queue, got %d", q.Len())
+	}
+	obj := get(t, q)
+	if obj.EventType != model.EventTypeDeleted {
+		t.Fatalf("expected latest event %s, got %s", model.EventTypeDeleted, obj.EventType)
+	}
+	if !q.Done(obj, nil) {
+		t.Fatal("expected done")
+	}
+	for k, v := range events {
+		if err := result(t, v.Done); err != nil {
+			t.Errorf("event %d: expected nil, got %v", k, err)
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	var transient = errors.New("transient")
+	var cases = []struct {
+		name       string
+		maxRetries int
+		errs       []error
+		requeues   int
+		dropped    uint64
+		want       error
+	}{
+		{
+			name:       "success",
+			maxRetries: 3,
+			errs:       []error{nil},
+		},
+		{
+			name:       "retry then success",
+			maxRetries: 3,
+			errs:       []error{transient, transient, nil},
+			requeues:   2,
+		},
+		{
+			name:       "permanent is not retried",
+			maxRetries: 3,
+			errs:       []error{utils.Permanent(transient)},
+			want:       transient,
+		},
+		{
+			name:       "retries exhausted",
+			maxRetries: 2,
+			errs:       []error{transient, transient, transient},
+			requeues:   2,
+			dropped:    1,
+			want:       ErrRetriesExhausted,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := newQueue(c.maxRetries)
+			defer q.ShutDown()
+			var obj = event(model.EventTypeAdded)
+			var done = obj.Done
+			q.Add(obj)
+			for k, err := range c.errs {
+				obj = get(t, q)
+				// 只有最后一次超过重试次数时丢弃
+				dropped := k == len(c.errs)-1 && c.dropped > 0
+				if ok := q.Done(obj, err); ok == dropped {
+					t.Fatalf("attempt %d: unexpected done result %v", k, ok)
+				}
+			}
+			err := result(t, done)
+			if c.want == nil && err != nil {
+				t.Fatalf("expected nil, got %v", err)
+			}
+			if c.want != nil && !errors.Is(err, c.want) {
+				t.Fatalf("expected %v, got %v", c.want, err)
+			}
+			if c.want == transient && !utils.IsPermanent(err) {
+				t.Errorf("expected permanent error, got %v", err)
+			}
+			stats := q.Stats()
+			if stats.Retries != uint64(c.requeues) || stats.Dropped != c.dropped {
+				t.Errorf("expected retries %d dropped %d, got %d %d", c.requeues, c.dropped, stats.Retries, stats.Dropped)
+			}
+			if stats.Depth != 0 || stats.Processing != 0 || len(stats.Requeues) != 0 {
+				t.Errorf("expected empty queue, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNewerDuringProcessing(t *testing.T) {
+	q := newQueue(3)
+	defer q.ShutDown()
+	var first = event(model.EventTypeAdded)
+	q.Add(first)
+	obj := get(t, q)
+	var second = event(model.EventTypeModified)
+	q.Add(second)
+	// 失败时不重试旧对象, 结果随最新对象回传
+	q.Done(obj, errors.New("transient"))
+	obj = get(t, q)
+	if obj.EventType != model.EventTypeModified {
+		t.Fatalf("expected newer event %s, got %s", model.EventTypeModified, obj.EventType)
+	}
+	q.Done(obj, nil)
+	for _, v := range []model.Event{first, second} {
+		if err := result(t, v.Done); err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+	}
+	if stats := q.Stats(); stats.Retries != 0 {
+		t.Errorf("expected no retry, got %d", stats.Retries)
+	}
+}
@@ -0,0 +1,44 @@
+package utils
+
+import "sync"
+
+// KeyLock 按键加锁, 不同键互不阻塞
+type KeyLock struct {
+	lock  *sync.Mutex
+	locks map[string]*keyLockEntry
+}
+
+type keyLockEntry struct {
+	lock *sync.Mutex
+	ref  int
+}
+
+func NewKeyLock() *KeyLock {
+	return &KeyLock{
+		lock:  new(sync.Mutex),
+		locks: make(map[string]*keyLockEntry),
+	}
+}
+
+// Lock 对key加锁, 返回解锁函数
+func (k *KeyLock) Lock(key string) func() {
+	k.lock.Lock()
+	e, ok := k.locks[key]
+	if !ok {
+		e = &keyLockEntry{lock: new(sync.Mutex)}
+		k.locks[key] = e
+	}
+	e.ref++
+	k.lock.Unlock()
+
+	e.lock.Lock()
+	return func() {
+		e.lock.Unlock()
+		k.lock.Lock()
+		e.ref--
+		if e.ref == 0 {
+			delete(k.locks, key)
+		}
+		k.lock.Unlock()
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"github.com/avast/retry-go/v4"
 	"github.com/sirupsen/logrus"
 	"time"
@@ -21,3 +22,28 @@ func Retry(num uint, msg string, fn func() error) error {
 		}),
 	)
 }
+
+// permanentError 无需重试的错误, 如配置或注解错误
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var e *permanentError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ValidateService 校验外部提交的Service并补全默认值
+func ValidateService(service *corev1.Service, requirePorts bool) error {
+	if service == nil {
+		return fmt.Errorf("service is null")
+	}
+	if service.Kind != "" && service.Kind != "Service" {
+		return fmt.Errorf("unsupported kind %s", service.Kind)
+	}
+	if service.Name == "" {
+		return fmt.Errorf("service name is required")
+	}
+	if service.Namespace == "" {
+		service.Namespace = metav1.NamespaceDefault
+	}
+	if service.Spec.Type == "" {
+		service.Spec.Type = corev1.ServiceTypeClusterIP
+	}
+	if requirePorts && len(service.Spec.Ports) == 0 {
+		return fmt.Errorf("service %s/%s has no ports", service.Namespace, service.Name)
+	}
+	var names = make(map[string]bool)
+	for k, v := range service.Spec.Ports {
+		if v.Port <= 0 || v.Port > 65535 {
+			return fmt.Errorf("service %s/%s has invalid port %d", service.Namespace, service.Name, v.Port)
+		}
+		if v.Protocol == "" {
+			service.Spec.Ports[k].Protocol = corev1.ProtocolTCP
+		}
+		if v.Name != "" {
+			if names[v.Name] {
+				return fmt.Errorf("service %s/%s has duplicate port name %s", service.Namespace, service.Name, v.Name)
+			}
+			names[v.Name] = true
+		}
+	}
+	return nil
+}